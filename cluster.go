@@ -0,0 +1,366 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// largeComponentSize is the size above which components are logged by clusterFiles,
+// since clustering them can be slow.
+const largeComponentSize = 500
+
+// Values for scanOptions.cluster.
+const (
+	componentsCluster = "components" // connected components (matches can chain)
+	completeCluster   = "complete"   // complete-linkage clustering (see completeLinkage)
+	cliqueCluster     = "clique"     // repeatedly-extracted maximum cliques (see maxCliques)
+)
+
+// filePair identifies an unordered pair of files.
+type filePair struct{ a, b fileID }
+
+// makeFilePair returns a filePair for a and b with the smaller ID first.
+func makeFilePair(a, b fileID) filePair {
+	if b < a {
+		a, b = b, a
+	}
+	return filePair{a, b}
+}
+
+// clusterFiles partitions the undirected graph described by edges into groups of
+// similar files using the specified method. scores contains each edge's comparison score.
+func clusterFiles(method string, edges map[fileID][]fileID, scores map[filePair]float64) ([][]fileID, error) {
+	comps := components(edges)
+	if method == componentsCluster {
+		return comps, nil
+	}
+
+	var groups [][]fileID
+	for _, comp := range comps {
+		if len(comp) > largeComponentSize {
+			log.Printf("Clustering %d connected files", len(comp))
+		}
+		switch method {
+		case completeCluster:
+			groups = append(groups, completeLinkage(comp, scores)...)
+		case cliqueCluster:
+			groups = append(groups, maxCliques(comp, edges, scores)...)
+		default:
+			return nil, fmt.Errorf("unknown clustering method %q", method)
+		}
+	}
+	return groups, nil
+}
+
+// components returns all components from the undirected graph described by edges.
+func components(edges map[fileID][]fileID) [][]fileID {
+	visited := make(map[fileID]struct{})
+
+	var search func(fileID) []fileID
+	search = func(src fileID) []fileID {
+		if _, ok := visited[src]; ok {
+			return nil
+		}
+		visited[src] = struct{}{}
+		comp := []fileID{src}
+		for _, dst := range edges[src] {
+			comp = append(comp, search(dst)...)
+		}
+		return comp
+	}
+
+	var comps [][]fileID
+	for src := range edges {
+		if _, ok := visited[src]; !ok {
+			comps = append(comps, search(src))
+		}
+	}
+	return comps
+}
+
+// completeLinkage performs complete-linkage agglomerative clustering on comp,
+// a component from the graph described by scores. Each file starts in its own
+// cluster, and the two clusters whose weakest link is strongest are repeatedly
+// merged. Clusters are only merged if every pair of files across them matched.
+// Clusters containing a single file are omitted.
+func completeLinkage(comp []fileID, scores map[filePair]float64) [][]fileID {
+	comp = append([]fileID(nil), comp...)
+	sortIDs(comp)
+	clusters := make([][]fileID, len(comp))
+	// links[i][j] holds the minimum score between clusters i and j. It's only
+	// present if every pair of files across the clusters matched.
+	links := make([]map[int]float64, len(comp))
+	var h linkHeap
+	for i, id := range comp {
+		clusters[i] = []fileID{id}
+		links[i] = make(map[int]float64)
+	}
+	for i := 0; i < len(comp)-1; i++ {
+		for j := i + 1; j < len(comp); j++ {
+			if sc, ok := scores[makeFilePair(comp[i], comp[j])]; ok {
+				links[i][j] = sc
+				links[j][i] = sc
+				h = append(h, clusterLink{i, j, sc})
+			}
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		l := heap.Pop(&h).(clusterLink)
+		// Skip links involving merged clusters or that have since been updated.
+		if clusters[l.i] == nil || clusters[l.j] == nil {
+			continue
+		} else if sc, ok := links[l.i][l.j]; !ok || sc != l.score {
+			continue
+		}
+
+		// Merge j into i. i's links to other clusters are only kept if j also
+		// linked to them.
+		clusters[l.i] = append(clusters[l.i], clusters[l.j]...)
+		clusters[l.j] = nil
+		for k, sc := range links[l.i] {
+			if k == l.j {
+				continue
+			}
+			if jsc, ok := links[l.j][k]; ok {
+				if jsc < sc {
+					sc = jsc
+				}
+				links[l.i][k] = sc
+				links[k][l.i] = sc
+				a, b := l.i, k
+				if b < a {
+					a, b = b, a
+				}
+				heap.Push(&h, clusterLink{a, b, sc})
+			} else {
+				delete(links[l.i], k)
+				delete(links[k], l.i)
+			}
+		}
+		delete(links[l.i], l.j)
+		for k := range links[l.j] {
+			delete(links[k], l.j)
+		}
+		links[l.j] = nil
+	}
+
+	var groups [][]fileID
+	for _, c := range clusters {
+		if len(c) > 1 {
+			groups = append(groups, c)
+		}
+	}
+	return groups
+}
+
+// clusterLink describes the link between clusters i and j (with i < j) in completeLinkage.
+type clusterLink struct {
+	i, j  int
+	score float64
+}
+
+// linkHeap implements heap.Interface for clusterLink. The strongest link is at the top,
+// with ties broken by preferring lower cluster indexes.
+type linkHeap []clusterLink
+
+func (h linkHeap) Len() int { return len(h) }
+func (h linkHeap) Less(a, b int) bool {
+	if h[a].score != h[b].score {
+		return h[a].score > h[b].score
+	}
+	if h[a].i != h[b].i {
+		return h[a].i < h[b].i
+	}
+	return h[a].j < h[b].j
+}
+func (h linkHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *linkHeap) Push(x interface{}) { *h = append(*h, x.(clusterLink)) }
+func (h *linkHeap) Pop() interface{} {
+	old := *h
+	l := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return l
+}
+
+// maxCliques splits comp, a component from the graph described by edges, by
+// repeatedly removing its largest clique (i.e. group of files that all matched
+// each other). Ties are broken by preferring the clique with the highest total
+// score. Cliques containing a single file are omitted.
+func maxCliques(comp []fileID, edges map[fileID][]fileID, scores map[filePair]float64) [][]fileID {
+	remaining := make(map[fileID]struct{}, len(comp))
+	adj := make(map[fileID]map[fileID]struct{}, len(comp))
+	for _, id := range comp {
+		remaining[id] = struct{}{}
+		adj[id] = make(map[fileID]struct{}, len(edges[id]))
+		for _, n := range edges[id] {
+			if n != id {
+				adj[id][n] = struct{}{}
+			}
+		}
+	}
+
+	var groups [][]fileID
+	for len(remaining) > 1 {
+		var best []fileID
+		var bestScore float64
+		bronKerbosch(nil, remaining, nil, adj, func(clique []fileID) {
+			if len(clique) < len(best) {
+				return
+			}
+			var sc float64
+			for i := 0; i < len(clique)-1; i++ {
+				for j := i + 1; j < len(clique); j++ {
+					sc += scores[makeFilePair(clique[i], clique[j])]
+				}
+			}
+			if len(clique) > len(best) || sc > bestScore {
+				best = append([]fileID(nil), clique...)
+				bestScore = sc
+			}
+		})
+		if len(best) < 2 {
+			break
+		}
+		groups = append(groups, best)
+		for _, id := range best {
+			delete(remaining, id)
+		}
+	}
+	return groups
+}
+
+// bronKerbosch runs the Bron-Kerbosch algorithm with Tomita pivoting to pass each
+// maximal clique in the graph described by adj to fn. r, p, and x are the current
+// clique, the candidate files, and the excluded files. Files that aren't in p or x
+// are ignored.
+func bronKerbosch(r []fileID, p, x map[fileID]struct{}, adj map[fileID]map[fileID]struct{}, fn func([]fileID)) {
+	if len(p) == 0 && len(x) == 0 {
+		fn(r)
+		return
+	}
+
+	// Choose the pivot with the most neighbors in p. Only candidates that aren't
+	// adjacent to it need to be visited, since any maximal clique must contain
+	// either the pivot or one of its non-neighbors.
+	var pivot fileID
+	most := -1
+	for _, set := range []map[fileID]struct{}{p, x} {
+		for u := range set {
+			var n int
+			for v := range p {
+				if _, ok := adj[u][v]; ok {
+					n++
+				}
+			}
+			if n > most || (n == most && u < pivot) {
+				pivot, most = u, n
+			}
+		}
+	}
+
+	// Visit candidates in a consistent order so results are repeatable.
+	cands := make([]fileID, 0, len(p))
+	for id := range p {
+		if _, ok := adj[pivot][id]; !ok {
+			cands = append(cands, id)
+		}
+	}
+	sortIDs(cands)
+
+	p = copySet(p)
+	x = copySet(x)
+	for _, v := range cands {
+		np := make(map[fileID]struct{})
+		nx := make(map[fileID]struct{})
+		for n := range adj[v] {
+			if _, ok := p[n]; ok {
+				np[n] = struct{}{}
+			}
+			if _, ok := x[n]; ok {
+				nx[n] = struct{}{}
+			}
+		}
+		bronKerbosch(append(r[:len(r):len(r)], v), np, nx, adj, fn)
+		delete(p, v)
+		x[v] = struct{}{}
+	}
+}
+
+// splitExcluded splits comp, a group of files from the graph described by edges,
+// so that no resulting group contains a pair in excluded. Matches are added in
+// order of decreasing score, and each one joins its files' groups unless that
+// would bring an excluded pair together. Groups containing a single file are omitted.
+func splitExcluded(comp []fileID, edges map[fileID][]fileID, scores map[filePair]float64,
+	excluded map[filePair]struct{}) [][]fileID {
+	members := make(map[fileID][]fileID, len(comp)) // group members, keyed by each member
+	for _, id := range comp {
+		members[id] = []fileID{id}
+	}
+
+	var pairs []filePair
+	for _, a := range comp {
+		for _, b := range edges[a] {
+			if _, ok := members[b]; ok && a < b {
+				pairs = append(pairs, filePair{a, b})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if si, sj := scores[pairs[i]], scores[pairs[j]]; si != sj {
+			return si > sj
+		}
+		if pairs[i].a != pairs[j].a {
+			return pairs[i].a < pairs[j].a
+		}
+		return pairs[i].b < pairs[j].b
+	})
+
+PairLoop:
+	for _, p := range pairs {
+		ga, gb := members[p.a], members[p.b]
+		if ga[0] == gb[0] {
+			continue // already in the same group
+		}
+		for _, a := range ga {
+			for _, b := range gb {
+				if _, ok := excluded[makeFilePair(a, b)]; ok {
+					continue PairLoop
+				}
+			}
+		}
+		merged := append(append([]fileID(nil), ga...), gb...)
+		sortIDs(merged)
+		for _, id := range merged {
+			members[id] = merged
+		}
+	}
+
+	var groups [][]fileID
+	for _, id := range comp {
+		if g := members[id]; len(g) > 1 && g[0] == id {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// copySet returns a copy of s.
+func copySet(s map[fileID]struct{}) map[fileID]struct{} {
+	c := make(map[fileID]struct{}, len(s))
+	for id := range s {
+		c[id] = struct{}{}
+	}
+	return c
+}
+
+// sortIDs sorts ids in ascending order.
+func sortIDs(ids []fileID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestComponents(t *testing.T) {
+	edges := make(map[fileID][]fileID)
+	add := func(a, b fileID) {
+		edges[a] = append(edges[a], b)
+		edges[b] = append(edges[b], a)
+	}
+	add(1, 2)
+	add(1, 3)
+	add(2, 3)
+	add(3, 4)
+	add(5, 6)
+	add(5, 7)
+
+	got := components(edges)
+	for i := range got {
+		sort.Slice(got[i], func(a, b int) bool { return got[i][a] < got[i][b] })
+	}
+	sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
+	if want := [][]fileID{{1, 2, 3, 4}, {5, 6, 7}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("components(...) = %v; want %v", got, want)
+	}
+}
+
+func TestClusterFiles(t *testing.T) {
+	// Files 1 and 2 are copies of one song, files 3 and 4 are copies of another,
+	// and file 5 is a medley that matches all of them.
+	edges := make(map[fileID][]fileID)
+	scores := make(map[filePair]float64)
+	add := func(a, b fileID, score float64) {
+		edges[a] = append(edges[a], b)
+		edges[b] = append(edges[b], a)
+		scores[makeFilePair(a, b)] = score
+	}
+	add(1, 2, 0.99)
+	add(3, 4, 0.98)
+	add(1, 5, 0.96)
+	add(2, 5, 0.96)
+	add(3, 5, 0.97)
+	add(4, 5, 0.97)
+	add(6, 7, 0.95)
+
+	for _, tc := range []struct {
+		method string
+		want   [][]fileID
+	}{
+		{componentsCluster, [][]fileID{{1, 2, 3, 4, 5}, {6, 7}}},
+		{completeCluster, [][]fileID{{1, 2}, {3, 4, 5}, {6, 7}}},
+		{cliqueCluster, [][]fileID{{1, 2}, {3, 4, 5}, {6, 7}}},
+	} {
+		got, err := clusterFiles(tc.method, edges, scores)
+		if err != nil {
+			t.Errorf("clusterFiles(%q, ...) failed: %v", tc.method, err)
+			continue
+		}
+		for i := range got {
+			sortIDs(got[i])
+		}
+		sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("clusterFiles(%q, ...) = %v; want %v", tc.method, got, tc.want)
+		}
+	}
+}
+
+func TestClusterFiles_Large(t *testing.T) {
+	// Two large sets of files that all match each other (e.g. an album that was
+	// imported many times) are connected by a few weaker matches. This is slow
+	// without pivoting in bronKerbosch.
+	const n = 40
+	edges := make(map[fileID][]fileID)
+	scores := make(map[filePair]float64)
+	add := func(a, b fileID, score float64) {
+		edges[a] = append(edges[a], b)
+		edges[b] = append(edges[b], a)
+		scores[makeFilePair(a, b)] = score
+	}
+	var first, second []fileID
+	for i := fileID(1); i <= n; i++ {
+		first = append(first, i)
+		second = append(second, i+n)
+		for j := i + 1; j <= n; j++ {
+			add(i, j, 0.95)
+			add(i+n, j+n, 0.96)
+		}
+	}
+	for i := fileID(1); i <= 5; i++ {
+		add(i, i+n, 0.9)
+	}
+
+	for _, method := range []string{completeCluster, cliqueCluster} {
+		got, err := clusterFiles(method, edges, scores)
+		if err != nil {
+			t.Errorf("clusterFiles(%q, ...) failed: %v", method, err)
+			continue
+		}
+		for i := range got {
+			sortIDs(got[i])
+		}
+		sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
+		if want := [][]fileID{first, second}; !reflect.DeepEqual(got, want) {
+			t.Errorf("clusterFiles(%q, ...) = %v; want %v", method, got, want)
+		}
+	}
+}
+
+func TestCompleteLinkage_Chain(t *testing.T) {
+	// With a chain of matches, complete-linkage clustering shouldn't join
+	// files that didn't match each other.
+	scores := map[filePair]float64{
+		makeFilePair(1, 2): 0.96,
+		makeFilePair(2, 3): 0.99,
+		makeFilePair(3, 4): 0.97,
+	}
+	got := completeLinkage([]fileID{4, 3, 2, 1}, scores)
+	for i := range got {
+		sortIDs(got[i])
+	}
+	sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
+	if want := [][]fileID{{2, 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("completeLinkage(...) = %v; want %v", got, want)
+	}
+}
+
+func TestSplitExcluded(t *testing.T) {
+	for _, tc := range []struct {
+		scores   map[filePair]float64
+		excluded []filePair
+		want     [][]fileID
+	}{
+		{
+			// 1 and 4 are connected via 2 and 3.
+			scores: map[filePair]float64{
+				makeFilePair(1, 2): 0.99,
+				makeFilePair(2, 3): 0.97,
+				makeFilePair(3, 4): 0.98,
+				makeFilePair(1, 3): 0.96,
+			},
+			excluded: []filePair{makeFilePair(1, 4)},
+			want:     [][]fileID{{1, 2}, {3, 4}},
+		},
+		{
+			// 2 matches 1 better than 3, so 3 is left out.
+			scores: map[filePair]float64{
+				makeFilePair(1, 2): 0.99,
+				makeFilePair(2, 3): 0.98,
+			},
+			excluded: []filePair{makeFilePair(1, 3)},
+			want:     [][]fileID{{1, 2}},
+		},
+		{
+			// Matches not involving excluded files are preserved.
+			scores: map[filePair]float64{
+				makeFilePair(1, 2): 0.96,
+				makeFilePair(1, 3): 0.97,
+				makeFilePair(2, 4): 0.98,
+				makeFilePair(4, 5): 0.99,
+			},
+			excluded: []filePair{makeFilePair(3, 5)},
+			want:     [][]fileID{{1, 3}, {2, 4, 5}},
+		},
+	} {
+		edges := make(map[fileID][]fileID)
+		for p := range tc.scores {
+			edges[p.a] = append(edges[p.a], p.b)
+			edges[p.b] = append(edges[p.b], p.a)
+		}
+		excluded := make(map[filePair]struct{})
+		for _, p := range tc.excluded {
+			excluded[p] = struct{}{}
+		}
+		comps := components(edges)
+		if len(comps) != 1 {
+			t.Fatalf("Test graph has %d components; want 1", len(comps))
+		}
+		got := splitExcluded(comps[0], edges, tc.scores, excluded)
+		sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitExcluded(%v, ...) with excluded %v = %v; want %v", comps[0], tc.excluded, got, tc.want)
+		}
+	}
+}
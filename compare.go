@@ -0,0 +1,266 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// compareFingerprints returns the ratio of identical bits in a and b to the
+// total bits in the longer (or shorter if minLength is true) of the two.
+// All possible alignments are checked, and the highest ratio is returned.
+func compareFingerprints(a, b []uint32, minLength bool) (ratio float64, aoff, boff int) {
+	return compareFingerprintsRange(a, b, minLength, -len(a), len(b))
+}
+
+// compareFingerprintsRange is similar to compareFingerprints but only checks
+// alignments where b is shifted by [lo, hi] positions relative to a, i.e. a[i] is
+// aligned with b[i+shift]. If no alignments overlap, 0 is returned.
+//
+// Rather than counting the matching bits at every alignment, alignments are
+// checked in order of decreasing overlap, starting from the best-looking
+// alignments according to seedShifts. Alignments that can't beat the best count
+// seen so far are abandoned, but the result is the same as that of an exhaustive
+// search: if multiple alignments have the same count, the one with the smallest
+// shift in a (followed by the one with the smallest shift in b) is returned.
+func compareFingerprintsRange(a, b []uint32, minLength bool, lo, hi int) (ratio float64, aoff, boff int) {
+	return compareFingerprintsMasked(a, b, nil, nil, minLength, lo, hi)
+}
+
+// compareFingerprintsMasked is similar to compareFingerprintsRange but ignores
+// positions in a and b where am and bm (which may be nil) are true. The returned
+// ratio is relative to the total unmasked bits in the longer (or shorter) of a and b.
+func compareFingerprintsMasked(a, b []uint32, am, bm []bool, minLength bool, lo, hi int) (ratio float64, aoff, boff int) {
+	if lo < -(len(a) - 1) {
+		lo = -(len(a) - 1)
+	}
+	if hi > len(b)-1 {
+		hi = len(b) - 1
+	}
+	if len(a) == 0 || len(b) == 0 || lo > hi {
+		return 0, 0, 0
+	}
+
+	// rank returns shift's position in the order used by an exhaustive search:
+	// the unshifted alignment, then increasing offsets into a, then increasing
+	// offsets into b. It's used to break ties.
+	rank := func(shift int) int {
+		if shift <= 0 {
+			return -shift
+		}
+		return len(a) + shift
+	}
+	split := func(shift int) (ao, bo int) {
+		if shift < 0 {
+			return -shift, 0
+		}
+		return 0, shift
+	}
+	overlap := func(shift int) int {
+		ao, bo := split(shift)
+		if n := len(b) - bo; n < len(a)-ao {
+			return n
+		}
+		return len(a) - ao
+	}
+
+	best, bestShift := -1, 0
+	better := func(cnt, shift int) bool {
+		return cnt > best || (cnt == best && rank(shift) < rank(bestShift))
+	}
+
+	// check counts the matching bits at shift and updates best if needed.
+	// It gives up early once it's clear that shift can't beat best.
+	check := func(shift int) {
+		const chunk = 64 // frames between early-exit checks
+		ao, bo := split(shift)
+		n := overlap(shift)
+		as, bs := a[ao:ao+n], b[bo:bo+n]
+		var cnt int
+		for i := 0; i < n; i += chunk {
+			if !better(cnt+32*(n-i), shift) {
+				return
+			}
+			end := i + chunk
+			if end > n {
+				end = n
+			}
+			if am == nil && bm == nil {
+				for j := i; j < end; j++ {
+					cnt += 32 - bits.OnesCount32(as[j]^bs[j])
+				}
+			} else {
+				for j := i; j < end; j++ {
+					if !isMasked(am, ao+j) && !isMasked(bm, bo+j) {
+						cnt += 32 - bits.OnesCount32(as[j]^bs[j])
+					}
+				}
+			}
+		}
+		if better(cnt, shift) {
+			best, bestShift = cnt, shift
+		}
+	}
+
+	// Start with the most-promising alignments to get a good lower bound.
+	for _, shift := range seedShifts(a, b, am, bm, lo, hi, 4) {
+		check(shift)
+	}
+
+	// Check all alignments in order of decreasing overlap, stopping when the number
+	// of overlapping bits is too low to beat the best count. Shifts are bucketed by
+	// overlap in rank order so that ties are checked in the proper order.
+	buckets := make([][]int, overlap(0)+1)
+	add := func(shift int) {
+		o := overlap(shift)
+		if o >= len(buckets) {
+			buckets = append(buckets, make([][]int, o+1-len(buckets))...)
+		}
+		buckets[o] = append(buckets[o], shift)
+	}
+	if lo <= 0 && hi >= 0 {
+		add(0)
+	}
+	for shift := -1; shift >= lo; shift-- {
+		if shift <= hi {
+			add(shift)
+		}
+	}
+	for shift := 1; shift <= hi; shift++ {
+		if shift >= lo {
+			add(shift)
+		}
+	}
+BucketLoop:
+	for o := len(buckets) - 1; o > 0; o-- {
+		for _, shift := range buckets[o] {
+			// Later alignments have less overlap or the same overlap and a higher rank.
+			if !better(32*o, shift) {
+				break BucketLoop
+			}
+			check(shift)
+		}
+	}
+
+	aoff, boff = split(bestShift)
+	total := maskedTotal(a, b, am, bm, minLength)
+	if total == 0 {
+		return 0, aoff, boff
+	}
+	return float64(best) / float64(32*total), aoff, boff
+}
+
+// isMasked returns true if mask is non-nil and mask[i] is true.
+func isMasked(mask []bool, i int) bool { return mask != nil && mask[i] }
+
+// maskedTotal returns the number of unmasked values in the longer (or shorter if
+// minLength is true) of a and b.
+func maskedTotal(a, b []uint32, am, bm []bool, minLength bool) int {
+	count := func(fprint []uint32, mask []bool) int {
+		n := len(fprint)
+		for _, m := range mask {
+			if m {
+				n--
+			}
+		}
+		return n
+	}
+	na, nb := count(a, am), count(b, bm)
+	if (minLength && nb < na) || (!minLength && nb > na) {
+		return nb
+	}
+	return na
+}
+
+// seedShifts returns up to max shifts in [lo, hi] at which a and b share the most
+// unmasked values after truncation with prefixKey. See compareFingerprintsRange.
+func seedShifts(a, b []uint32, am, bm []bool, lo, hi, max int) []int {
+	// Skip values that appear many times (e.g. silence) to avoid quadratic behavior.
+	const maxPairs = 64
+
+	votes := make(map[int]int)
+	akps, bkps := sortKeys(a, am, prefixKey), sortKeys(b, bm, prefixKey)
+	for i, j := 0, 0; i < len(akps) && j < len(bkps); {
+		if akps[i].key < bkps[j].key {
+			i++
+			continue
+		} else if akps[i].key > bkps[j].key {
+			j++
+			continue
+		}
+		key := akps[i].key
+		ae, be := i, j
+		for ae < len(akps) && akps[ae].key == key {
+			ae++
+		}
+		for be < len(bkps) && bkps[be].key == key {
+			be++
+		}
+		if (ae-i)*(be-j) <= maxPairs {
+			for _, akp := range akps[i:ae] {
+				for _, bkp := range bkps[j:be] {
+					if shift := bkp.pos - akp.pos; shift >= lo && shift <= hi {
+						votes[shift]++
+					}
+				}
+			}
+		}
+		i, j = ae, be
+	}
+
+	shifts := make([]int, 0, len(votes))
+	for shift := range votes {
+		shifts = append(shifts, shift)
+	}
+	sort.Slice(shifts, func(i, j int) bool {
+		if vi, vj := votes[shifts[i]], votes[shifts[j]]; vi != vj {
+			return vi > vj
+		}
+		return shifts[i] < shifts[j]
+	})
+	if len(shifts) > max {
+		shifts = shifts[:max]
+	}
+	return shifts
+}
+
+// frameScore returns the ratio of aligned values in a[aoff:] and b[boff:] that
+// differ by at most maxBits bits to the total values in the longer (or shorter
+// if minLength is true) of a and b. Unlike the bitwise ratio returned by
+// compareFingerprints, a few badly-mismatched regions can't be hidden by an
+// otherwise-good match (and vice versa). Positions where am or bm (which may be
+// nil) are true are ignored.
+func frameScore(a, b []uint32, am, bm []bool, aoff, boff int, minLength bool, maxBits int) float64 {
+	total := maskedTotal(a, b, am, bm, minLength)
+	if total == 0 {
+		return 0
+	}
+	var cnt int
+	for i, j := aoff, boff; i < len(a) && j < len(b); i, j = i+1, j+1 {
+		if !isMasked(am, i) && !isMasked(bm, j) && bits.OnesCount32(a[i]^b[j]) <= maxBits {
+			cnt++
+		}
+	}
+	return float64(cnt) / float64(total)
+}
+
+// compareContained looks for short within long, only checking alignments where
+// all of short overlaps long and short starts at a position in [lo, hi] in long.
+// It returns the ratio of identical bits to the total unmasked bits in short and the
+// position in long where short starts. If no alignments are possible, 0 is returned.
+// Positions where sm or lm (which may be nil) are true are ignored.
+func compareContained(short, long []uint32, sm, lm []bool, lo, hi int) (ratio float64, off int) {
+	if lo < 0 {
+		lo = 0
+	}
+	if max := len(long) - len(short); hi > max {
+		hi = max
+	}
+	if lo > hi {
+		return 0, 0
+	}
+	ratio, _, off = compareFingerprintsMasked(short, long, sm, lm, true, lo, hi)
+	return ratio, off
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func TestCompareFingerprints(t *testing.T) {
+	for _, tc := range []struct {
+		a, b       []uint32
+		minLength  bool
+		score      float64
+		aoff, boff int
+	}{
+		{
+			[]uint32{0x0000ffe4},
+			[]uint32{0xffff0f14},
+			false, 8.0 / 32, 0, 0,
+		},
+		{
+			[]uint32{0xfffffffe, 0x80000001},
+			[]uint32{0x7fffffff, 0xf0000001},
+			false, 59.0 / 64, 0, 0,
+		},
+		{
+			[]uint32{0x00000000, 0x01010101, 0xffffffff, 0xcafebeef},
+			[]uint32{0x01010101, 0xffffffff, 0xcafebeef, 0x00000000},
+			false, 96.0 / 128, 1, 0,
+		},
+		{
+			[]uint32{0xffffffff, 0x01010101},
+			[]uint32{0x00000000, 0xffffffff, 0x01010101},
+			false, 64.0 / 96, 0, 1,
+		},
+		{
+			[]uint32{0x00000000, 0xffffffff, 0x01010101},
+			[]uint32{0xffffffff, 0x01010101},
+			true, 64.0 / 64, 1, 0,
+		},
+	} {
+		if score, aoff, boff := compareFingerprints(tc.a, tc.b, tc.minLength); score != tc.score || aoff != tc.aoff || boff != tc.boff {
+			t.Errorf("compareFingerprints(%v, %v, %v) = (%0.3f, %d, %d); want (%0.3f, %d, %d)",
+				tc.a, tc.b, tc.minLength, score, aoff, boff, tc.score, tc.aoff, tc.boff)
+		}
+	}
+}
+
+// compareFingerprintsExhaustive is a straightforward implementation of
+// compareFingerprintsRange that checks every alignment.
+func compareFingerprintsExhaustive(a, b []uint32, minLength bool, lo, hi int) (ratio float64, aoff, boff int) {
+	if lo < -(len(a) - 1) {
+		lo = -(len(a) - 1)
+	}
+	if hi > len(b)-1 {
+		hi = len(b) - 1
+	}
+	if len(a) == 0 || len(b) == 0 || lo > hi {
+		return 0, 0, 0
+	}
+
+	count := func(a, b []uint32) int {
+		var cnt int
+		for i := 0; i < len(a) && i < len(b); i++ {
+			cnt += 32 - bits.OnesCount32(a[i]^b[i])
+		}
+		return cnt
+	}
+
+	best := -1
+	check := func(ao, bo int) {
+		if cnt := count(a[ao:], b[bo:]); cnt > best {
+			best = cnt
+			aoff, boff = ao, bo
+		}
+	}
+	if lo <= 0 && hi >= 0 {
+		check(0, 0)
+	}
+	for i := 1; i <= -lo; i++ {
+		if -i <= hi {
+			check(i, 0)
+		}
+	}
+	for i := 1; i <= hi; i++ {
+		if i >= lo {
+			check(0, i)
+		}
+	}
+
+	total := len(a)
+	if (minLength && len(b) < total) || (!minLength && len(b) > total) {
+		total = len(b)
+	}
+	return float64(best) / float64(32*total), aoff, boff
+}
+
+// randFingerprint returns a pseudorandom fingerprint of length n.
+func randFingerprint(r *rand.Rand, n int) []uint32 {
+	fp := make([]uint32, n)
+	for i := range fp {
+		fp[i] = r.Uint32()
+	}
+	return fp
+}
+
+// noisyFingerprint returns a copy of fp with the first pad values replaced by
+// pseudorandom values and each bit flipped with probability 1/(2^flipShift).
+func noisyFingerprint(r *rand.Rand, fp []uint32, pad int, flipShift int) []uint32 {
+	noisy := append(randFingerprint(r, pad), fp...)
+	for i := range noisy {
+		for j := 0; j < 32; j++ {
+			if r.Intn(1<<uint(flipShift)) == 0 {
+				noisy[i] ^= 1 << uint(j)
+			}
+		}
+	}
+	return noisy
+}
+
+func TestCompareFingerprintsRange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randFingerprint(r, 1+r.Intn(40))
+		var b []uint32
+		switch i % 3 {
+		case 0: // unrelated
+			b = randFingerprint(r, 1+r.Intn(40))
+		case 1: // similar
+			b = noisyFingerprint(r, a, r.Intn(5), 3)
+		case 2: // repetitive
+			a = make([]uint32, 1+r.Intn(40))
+			b = make([]uint32, 1+r.Intn(40))
+		}
+		minLength := r.Intn(2) == 0
+		for _, rng := range [][2]int{{-100, 100}, {-5, 5}, {0, 0}, {-3, -1}, {2, 4}, {50, 60}} {
+			lo, hi := rng[0], rng[1]
+			gs, ga, gb := compareFingerprintsRange(a, b, minLength, lo, hi)
+			ws, wa, wb := compareFingerprintsExhaustive(a, b, minLength, lo, hi)
+			if gs != ws || ga != wa || gb != wb {
+				t.Errorf("compareFingerprintsRange(%v, %v, %v, %d, %d) = (%0.3f, %d, %d); want (%0.3f, %d, %d)",
+					a, b, minLength, lo, hi, gs, ga, gb, ws, wa, wb)
+			}
+		}
+	}
+}
+
+func BenchmarkCompareFingerprints(b *testing.B) {
+	// Use lengths similar to what -compare produces for four-minute songs.
+	const n = 2000
+	r := rand.New(rand.NewSource(1))
+	orig := randFingerprint(r, n)
+	for _, tc := range []struct {
+		name  string
+		other []uint32
+	}{
+		{"similar", noisyFingerprint(r, orig, 20, 4)},
+		{"different", randFingerprint(r, n)},
+	} {
+		for _, impl := range []struct {
+			name string
+			fn   func(a, b []uint32, minLength bool, lo, hi int) (float64, int, int)
+		}{
+			{"exhaustive", compareFingerprintsExhaustive},
+			{"fast", compareFingerprintsRange},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", impl.name, tc.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					impl.fn(orig, tc.other, false, -n, n)
+				}
+			})
+		}
+	}
+}
+
+func TestCompareContained(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	long := randFingerprint(r, 200)
+	const start = 50
+	short := noisyFingerprint(r, long[start:start+30], 0, 4)
+
+	if score, off := compareContained(short, long, nil, nil, -1000, 1000); score < 0.9 || off != start {
+		t.Errorf("compareContained(short, long, nil, nil, -1000, 1000) = (%0.3f, %d); want (>= 0.9, %d)", score, off, start)
+	}
+	if score, off := compareContained(short, long, nil, nil, start-2, start+2); score < 0.9 || off != start {
+		t.Errorf("compareContained(short, long, %d, %d) = (%0.3f, %d); want (>= 0.9, %d)",
+			start-2, start+2, score, off, start)
+	}
+	if score, _ := compareContained(short, long, nil, nil, 0, start-10); score >= 0.9 {
+		t.Errorf("compareContained(short, long, nil, nil, 0, %d) = %0.3f; want < 0.9", start-10, score)
+	}
+	// short can't extend past the end of long.
+	if score, _ := compareContained(long[170:], long, nil, nil, 180, 200); score != 0 {
+		t.Errorf("compareContained(long[170:], long, nil, nil, 180, 200) = %0.3f; want 0", score)
+	}
+}
+
+func TestFrameScore(t *testing.T) {
+	for _, tc := range []struct {
+		a, b       []uint32
+		aoff, boff int
+		minLength  bool
+		maxBits    int
+		want       float64
+	}{
+		{[]uint32{0x0, 0x0, 0x0, 0x0}, []uint32{0x0, 0x1, 0x3, 0x7}, 0, 0, false, 0, 1.0 / 4},
+		{[]uint32{0x0, 0x0, 0x0, 0x0}, []uint32{0x0, 0x1, 0x3, 0x7}, 0, 0, false, 2, 3.0 / 4},
+		{[]uint32{0x0, 0x0, 0x0, 0x0}, []uint32{0x0, 0x1, 0x3, 0x7}, 0, 0, false, 32, 4.0 / 4},
+		{[]uint32{0xffffffff, 0x0, 0x0}, []uint32{0x0, 0x0}, 1, 0, false, 0, 2.0 / 3},
+		{[]uint32{0xffffffff, 0x0, 0x0}, []uint32{0x0, 0x0}, 1, 0, true, 0, 2.0 / 2},
+		{[]uint32{0x0, 0x0}, []uint32{0xffffffff, 0x0, 0x0, 0x0}, 0, 1, false, 1, 2.0 / 4},
+		{[]uint32{}, []uint32{0x0}, 0, 0, false, 1, 0},
+	} {
+		if got := frameScore(tc.a, tc.b, nil, nil, tc.aoff, tc.boff, tc.minLength, tc.maxBits); got != tc.want {
+			t.Errorf("frameScore(%v, %v, %d, %d, %v, %d) = %0.3f; want %0.3f",
+				tc.a, tc.b, tc.aoff, tc.boff, tc.minLength, tc.maxBits, got, tc.want)
+		}
+	}
+}
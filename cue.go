@@ -0,0 +1,162 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cueRegexp matches CUE sheet filenames.
+var cueRegexp = regexp.MustCompile(`(?i)\.cue$`)
+
+// cueTrack describes a track listed in a CUE sheet.
+type cueTrack struct {
+	file  string  // audio file path relative to the CUE sheet's directory
+	num   int     // track number
+	start float64 // seconds into file where track starts
+	end   float64 // seconds into file where track ends (0 if it ends with the file)
+}
+
+// readCueSheet reads and parses the CUE sheet at name within fsys.
+func readCueSheet(fsys fs.FS, name string) ([]cueTrack, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCueSheet(f)
+}
+
+// parseCueSheet parses a CUE sheet from r and returns its audio tracks.
+// Each track starts at its "INDEX 01" position and ends at the start of the next
+// track in the same file.
+func parseCueSheet(r io.Reader) ([]cueTrack, error) {
+	var tracks []cueTrack
+	var file string
+	var track *cueTrack // current track, or nil if not in an audio track
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		fields := splitCueFields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: missing filename", ln)
+			}
+			file = fields[1]
+			track = nil
+		case "TRACK":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: bad track", ln)
+			}
+			track = nil
+			if strings.ToUpper(fields[2]) != "AUDIO" {
+				continue
+			}
+			if file == "" {
+				return nil, fmt.Errorf("line %d: track before file", ln)
+			}
+			num, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad track number %q", ln, fields[1])
+			}
+			tracks = append(tracks, cueTrack{file: file, num: num, start: -1})
+			track = &tracks[len(tracks)-1]
+		case "INDEX":
+			if track == nil || len(fields) < 3 || fields[1] != "01" {
+				continue
+			}
+			sec, err := parseCueTime(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", ln, err)
+			}
+			track.start = sec
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tracks {
+		t := &tracks[i]
+		if t.start < 0 {
+			return nil, fmt.Errorf("track %d missing INDEX 01", t.num)
+		}
+		if i > 0 {
+			if prev := &tracks[i-1]; prev.file == t.file {
+				if t.start <= prev.start {
+					return nil, fmt.Errorf("track %d doesn't start after track %d", t.num, prev.num)
+				}
+				prev.end = t.start
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// splitCueFields splits a CUE sheet line into whitespace-separated fields.
+// Double-quoted fields can contain whitespace.
+func splitCueFields(ln string) []string {
+	var fields []string
+	ln = strings.TrimSpace(ln)
+	for ln != "" {
+		var f string
+		if ln[0] == '"' {
+			if end := strings.IndexByte(ln[1:], '"'); end >= 0 {
+				f, ln = ln[1:end+1], ln[end+2:]
+			} else {
+				f, ln = ln[1:], ""
+			}
+		} else if end := strings.IndexAny(ln, " \t"); end >= 0 {
+			f, ln = ln[:end], ln[end:]
+		} else {
+			f, ln = ln, ""
+		}
+		fields = append(fields, f)
+		ln = strings.TrimLeft(ln, " \t")
+	}
+	return fields
+}
+
+// parseCueTime parses a CUE sheet "mm:ss:ff" time (with 75 frames per second)
+// and returns the number of seconds.
+func parseCueTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	var vals [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		vals[i] = v
+	}
+	if vals[1] >= 60 || vals[2] >= 75 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return float64(vals[0]*60+vals[1]) + float64(vals[2])/75, nil
+}
+
+// trackPath returns the path used for the specified track within the audio file at p.
+func trackPath(p string, num int) string { return fmt.Sprintf("%s#%d", p, num) }
+
+// isTrackPath returns true if p was returned by trackPath.
+func isTrackPath(p string) bool {
+	i := strings.LastIndexByte(p, '#')
+	if i < 0 || i == len(p)-1 {
+		return false
+	}
+	_, err := strconv.Atoi(p[i+1:])
+	return err == nil
+}
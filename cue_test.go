@@ -0,0 +1,90 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCueSheet = `REM GENRE Rock
+PERFORMER "Some Artist"
+TITLE "Some Album"
+FILE "Some Album.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second"
+    INDEX 00 03:10:00
+    INDEX 01 03:12:30
+  TRACK 03 AUDIO
+    INDEX 01 07:01:74
+FILE bonus.flac WAVE
+  TRACK 04 AUDIO
+    INDEX 01 00:00:00
+`
+
+func TestParseCueSheet(t *testing.T) {
+	got, err := parseCueSheet(strings.NewReader(testCueSheet))
+	if err != nil {
+		t.Fatal("parseCueSheet failed: ", err)
+	}
+	want := []cueTrack{
+		{"Some Album.flac", 1, 0, 192.4},
+		{"Some Album.flac", 2, 192.4, 421 + 74.0/75},
+		{"Some Album.flac", 3, 421 + 74.0/75, 0},
+		{"bonus.flac", 4, 0, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCueSheet returned %+v; want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		"TRACK 01 AUDIO\n  INDEX 01 00:00:00\n",                     // no file
+		"FILE a.flac WAVE\n  TRACK 01 AUDIO\n",                      // no index
+		"FILE a.flac WAVE\n  TRACK 01 AUDIO\n  INDEX 01 00:61:00\n", // bad time
+		"FILE a.flac WAVE\n  TRACK xx AUDIO\n  INDEX 01 00:00:00\n", // bad number
+		"FILE a.flac WAVE\n  TRACK 01 AUDIO\n  INDEX 01 01:00:00\n" + // out of order
+			"  TRACK 02 AUDIO\n  INDEX 01 00:30:00\n",
+	} {
+		if tracks, err := parseCueSheet(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseCueSheet(%q) unexpectedly returned %+v", bad, tracks)
+		}
+	}
+}
+
+func TestSplitCueFields(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{`  FILE "My Album.flac" WAVE`, []string{"FILE", "My Album.flac", "WAVE"}},
+		{"\tINDEX 01  00:00:00 ", []string{"INDEX", "01", "00:00:00"}},
+		{`TITLE "Unterminated`, []string{"TITLE", "Unterminated"}},
+		{`TITLE ""`, []string{"TITLE", ""}},
+	} {
+		if got := splitCueFields(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitCueFields(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestIsTrackPath(t *testing.T) {
+	for _, tc := range []struct {
+		p    string
+		want bool
+	}{
+		{trackPath("a/b.flac", 3), true},
+		{"a/b.flac", false},
+		{"a/Song #1.mp3", false},
+		{"a/b.flac#", false},
+	} {
+		if got := isTrackPath(tc.p); got != tc.want {
+			t.Errorf("isTrackPath(%q) = %v; want %v", tc.p, got, tc.want)
+		}
+	}
+}
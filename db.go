@@ -16,8 +16,21 @@ import (
 
 var dbByteOrder = binary.LittleEndian
 
+// lookupSchema contains statements for creating tables used to save lookupTable.
+var lookupSchema = []string{
+	`CREATE TABLE IF NOT EXISTS LookupInfo (Desc STRING PRIMARY KEY NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS LookupLists (
+		Key INTEGER PRIMARY KEY NOT NULL,
+		IDs BLOB NOT NULL,
+		Positions BLOB NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS LookupFiles (ID INTEGER PRIMARY KEY NOT NULL)`,
+}
+
 // audioDB holds previously-computed audio fingerprints.
-type audioDB struct{ db *sql.DB }
+type audioDB struct {
+	db     *sql.DB
+	masker *segmentMasker // nil if no segments have been saved
+}
 
 // newAudioDB opens or creates a audioDB at path with the supplied settings.
 // An error is returned if an existing database was created with different settings.
@@ -41,16 +54,48 @@ func newAudioDB(path string, settings *fpcalcSettings) (*audioDB, error) {
 			Path STRING PRIMARY KEY NOT NULL,
 			Duration FLOAT NOT NULL,
 			Size INTEGER NOT NULL,
-			Fingerprint BLOB NOT NULL)`,
+			Fingerprint BLOB NOT NULL,
+			Short BOOLEAN NOT NULL DEFAULT 0,
+			Hash BLOB)`,
 		`CREATE TABLE IF NOT EXISTS ExcludedPairs (
 			PathA STRING NOT NULL,
 			PathB STRING NOT NULL,
+			Tier STRING NOT NULL DEFAULT '',
 			PRIMARY KEY (PathA, PathB))`,
+		`CREATE TABLE IF NOT EXISTS Segments (
+			Path STRING PRIMARY KEY NOT NULL,
+			Fingerprint BLOB NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS ExtraFingerprints (
+			Path STRING NOT NULL,
+			Settings STRING NOT NULL,
+			Fingerprint BLOB NOT NULL,
+			PRIMARY KEY (Path, Settings))`,
 	} {
 		if _, err = db.Exec(q); err != nil {
 			return nil, err
 		}
 	}
+	// Some columns were added later, so add them to older databases.
+	for _, c := range []struct{ table, col, def string }{
+		{"Files", "Short", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"ExcludedPairs", "Tier", "STRING NOT NULL DEFAULT ''"},
+		{"Files", "Hash", "BLOB"},
+	} {
+		var n int
+		if err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.col).
+			Scan(&n); err != nil {
+			return nil, err
+		} else if n == 0 {
+			if _, err = db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.col + ` ` + c.def); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, q := range lookupSchema {
+		if _, err = db.Exec(q); err != nil {
+			return nil, err
+		}
+	}
 
 	// Check that the database wasn't created with different settings from what we're using now.
 	var dbSettings string
@@ -66,7 +111,10 @@ func newAudioDB(path string, settings *fpcalcSettings) (*audioDB, error) {
 		return nil, err
 	}
 
-	adb := &audioDB{db}
+	adb := &audioDB{db: db}
+	if err := adb.loadSegments(); err != nil {
+		return nil, err
+	}
 	db = nil // disarm Close() call
 	return adb, nil
 }
@@ -83,13 +131,15 @@ type fileInfo struct {
 	size     int64   // bytes
 	duration float64 // seconds
 	fprint   []uint32
+	short    bool   // fingerprinted by looping a short clip, so matches are lower-confidence
+	mask     []bool // positions in fprint matching known segments (nil if none); not saved
 }
 
 // get returns information about the file with the specified ID or relative path.
 // If the file is not present in the database, nil is returned.
 func (adb *audioDB) get(id fileID, path string) (*fileInfo, error) {
 	// ROWID is automatically assigned by SQLite: https://www.sqlite.org/autoinc.html
-	pre := `SELECT ROWID, Path, Size, Duration, Fingerprint FROM Files WHERE `
+	pre := `SELECT ROWID, Path, Size, Duration, Fingerprint, Short FROM Files WHERE `
 	var row *sql.Row
 	if id > 0 {
 		row = adb.db.QueryRow(pre+`ROWID = ?`, id)
@@ -97,22 +147,59 @@ func (adb *audioDB) get(id fileID, path string) (*fileInfo, error) {
 		row = adb.db.QueryRow(pre+`Path = ?`, path)
 	}
 
-	var b []byte
-	var info fileInfo
-	if err := row.Scan(&info.id, &info.path, &info.size, &info.duration, &b); err == sql.ErrNoRows {
+	info, err := scanFileInfo(row)
+	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
+	return info, nil
+}
+
+// forEach calls fn with information about each file in the database.
+func (adb *audioDB) forEach(fn func(info *fileInfo) error) error {
+	rows, err := adb.db.Query(`SELECT ROWID, Path, Size, Duration, Fingerprint, Short FROM Files ORDER BY ROWID`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		info, err := scanFileInfo(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
+// scanFileInfo reads a row containing ROWID, Path, Size, Duration, Fingerprint,
+// and Short columns from the Files table.
+func scanFileInfo(row interface{ Scan(...interface{}) error }) (*fileInfo, error) {
+	var b []byte
+	var info fileInfo
+	if err := row.Scan(&info.id, &info.path, &info.size, &info.duration, &b, &info.short); err != nil {
+		return nil, err
+	}
+	var err error
+	if info.fprint, err = decodeFingerprint(b); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// decodeFingerprint decodes a fingerprint stored in a BLOB column.
+func decodeFingerprint(b []byte) ([]uint32, error) {
 	if len(b)%4 != 0 {
 		return nil, fmt.Errorf("invalid fingerprint size %v", len(b))
 	}
-	info.fprint = make([]uint32, 0, len(b)/4)
+	fprint := make([]uint32, 0, len(b)/4)
 	for i := 0; i < len(b); i += 4 {
-		info.fprint = append(info.fprint, dbByteOrder.Uint32(b[i:i+4]))
+		fprint = append(fprint, dbByteOrder.Uint32(b[i:i+4]))
 	}
-	return &info, nil
+	return fprint, nil
 }
 
 // save saves the supplied file information to the database.
@@ -122,8 +209,8 @@ func (adb *audioDB) save(info *fileInfo) (id fileID, err error) {
 	if err := binary.Write(&b, dbByteOrder, info.fprint); err != nil {
 		return 0, err
 	}
-	res, err := adb.db.Exec(`INSERT INTO Files (Path, Size, Duration, Fingerprint) VALUES(?, ?, ?, ?)`,
-		info.path, info.size, info.duration, b.Bytes())
+	res, err := adb.db.Exec(`INSERT INTO Files (Path, Size, Duration, Fingerprint, Short) VALUES(?, ?, ?, ?, ?)`,
+		info.path, info.size, info.duration, b.Bytes(), info.short)
 	if err != nil {
 		return 0, err
 	}
@@ -139,25 +226,264 @@ func (adb *audioDB) save(info *fileInfo) (id fileID, err error) {
 	return fileID(id64), nil
 }
 
+// getHash returns the hash previously passed to saveHash for the specified file.
+// If the hash isn't present, nil is returned.
+func (adb *audioDB) getHash(id fileID) ([]byte, error) {
+	var b []byte
+	if err := adb.db.QueryRow(`SELECT Hash FROM Files WHERE ROWID = ?`, id).Scan(&b); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// saveHash saves a hash of the specified file's contents.
+func (adb *audioDB) saveHash(id fileID, hash []byte) error {
+	_, err := adb.db.Exec(`UPDATE Files SET Hash = ? WHERE ROWID = ?`, hash, id)
+	return err
+}
+
+// mask returns a mask for fprint identifying regions that match segments saved via
+// saveSegment. nil is returned if no regions match.
+func (adb *audioDB) mask(fprint []uint32) []bool {
+	if adb.masker == nil {
+		return nil
+	}
+	return adb.masker.mask(fprint)
+}
+
+// saveSegment saves the fingerprint of a known segment (e.g. an intro shared by many
+// files) from the file at path. Regions of files matching the segment will be masked.
+// The saved lookup table is cleared since it was built without the segment.
+func (adb *audioDB) saveSegment(path string, fprint []uint32) error {
+	var b bytes.Buffer
+	if err := binary.Write(&b, dbByteOrder, fprint); err != nil {
+		return err
+	}
+	if _, err := adb.db.Exec(`REPLACE INTO Segments (Path, Fingerprint) VALUES(?, ?)`, path, b.Bytes()); err != nil {
+		return err
+	}
+	if err := adb.resetLookupTable(); err != nil {
+		return err
+	}
+	return adb.loadSegments()
+}
+
+// loadSegments initializes adb.masker using segments saved via saveSegment.
+func (adb *audioDB) loadSegments() error {
+	rows, err := adb.db.Query(`SELECT Fingerprint FROM Segments ORDER BY Path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var segs [][]uint32
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+		seg, err := decodeFingerprint(b)
+		if err != nil {
+			return err
+		}
+		segs = append(segs, seg)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	adb.masker = nil
+	if len(segs) > 0 {
+		adb.masker = newSegmentMasker(segs)
+	}
+	return nil
+}
+
+// getExtraFingerprint returns the fingerprint previously passed to saveExtraFingerprint
+// for the file at the specified relative path and settings. If the fingerprint isn't
+// present, nil is returned.
+func (adb *audioDB) getExtraFingerprint(path string, settings *fpcalcSettings) ([]uint32, error) {
+	var b []byte
+	if err := adb.db.QueryRow(`SELECT Fingerprint FROM ExtraFingerprints WHERE Path = ? AND Settings = ?`,
+		path, settings.String()).Scan(&b); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeFingerprint(b)
+}
+
+// saveExtraFingerprint saves a fingerprint of the file at path that was computed using
+// different settings (e.g. a longer length or a different algorithm) from those used for
+// the Files table.
+func (adb *audioDB) saveExtraFingerprint(path string, settings *fpcalcSettings, fprint []uint32) error {
+	var b bytes.Buffer
+	if err := binary.Write(&b, dbByteOrder, fprint); err != nil {
+		return err
+	}
+	// Empty fingerprints are saved to avoid rerunning fpcalc, but b.Bytes() returns nil
+	// for them, which would be bound as NULL.
+	_, err := adb.db.Exec(`REPLACE INTO ExtraFingerprints (Path, Settings, Fingerprint) VALUES(?, ?, ?)`,
+		path, settings.String(), append([]byte{}, b.Bytes()...))
+	return err
+}
+
 // saveExcludedPair records that the supplied paths are not duplicates of each other.
-func (adb *audioDB) saveExcludedPair(pa, pb string) error {
+// If tier is non-empty, the paths are only excluded from being matched at the named
+// tier and less-strict tiers (see scanOptions.tiers).
+func (adb *audioDB) saveExcludedPair(pa, pb, tier string) error {
 	if pb < pa {
 		pa, pb = pb, pa
 	}
-	_, err := adb.db.Exec(`REPLACE INTO ExcludedPairs (PathA, PathB) VALUES(?, ?)`, pa, pb)
+	_, err := adb.db.Exec(`REPLACE INTO ExcludedPairs (PathA, PathB, Tier) VALUES(?, ?, ?)`, pa, pb, tier)
 	return err
 }
 
-// isExcludedPair returns true if the supplied paths have previously been recorded as
-// not being duplicates of each other.
-func (adb *audioDB) isExcludedPair(pa, pb string) (bool, error) {
+// getExcludedPair returns true if the supplied paths have previously been recorded as
+// not being duplicates of each other. The tier passed to saveExcludedPair is also returned.
+func (adb *audioDB) getExcludedPair(pa, pb string) (excluded bool, tier string, err error) {
 	if pb < pa {
 		pa, pb = pb, pa
 	}
-	if rows, err := adb.db.Query(`SELECT * FROM ExcludedPairs WHERE PathA = ? AND PathB = ?`, pa, pb); err != nil {
-		return false, err
-	} else {
-		defer rows.Close()
-		return rows.Next(), nil
+	err = adb.db.QueryRow(`SELECT Tier FROM ExcludedPairs WHERE PathA = ? AND PathB = ?`, pa, pb).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	return true, tier, nil
+}
+
+// resetLookupTable deletes the table saved via saveLookupTable.
+func (adb *audioDB) resetLookupTable() error {
+	// Recreate the tables in case their columns have changed.
+	for _, q := range append([]string{
+		`DROP TABLE LookupInfo`,
+		`DROP TABLE LookupLists`,
+		`DROP TABLE LookupFiles`,
+	}, lookupSchema...) {
+		if _, err := adb.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLookupTable returns the lookup table previously saved via saveLookupTable.
+// If no table was saved or the saved table used a different format, an empty table
+// is returned (and the old table is deleted).
+func (adb *audioDB) loadLookupTable() (*lookupTable, error) {
+	t := newLookupTable()
+
+	var desc string
+	if err := adb.db.QueryRow(`SELECT Desc FROM LookupInfo`).Scan(&desc); err == sql.ErrNoRows {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	} else if desc != lookupTableDesc {
+		if err := adb.resetLookupTable(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	rows, err := adb.db.Query(`SELECT Key, IDs, Positions FROM LookupLists`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key int
+		var ids, pos []byte
+		if err := rows.Scan(&key, &ids, &pos); err != nil {
+			return nil, err
+		}
+		if key < 0 || key >= len(t.lists) {
+			return nil, fmt.Errorf("invalid lookup key %v", key)
+		}
+		if len(ids)%4 != 0 || len(pos)%2 != 0 || len(ids)/4 != len(pos)/2 {
+			return nil, fmt.Errorf("invalid list sizes %v and %v for lookup key %v", len(ids), len(pos), key)
+		}
+		pl := &t.lists[key]
+		pl.ids = make([]fileID, len(ids)/4)
+		pl.pos = make([]uint16, len(pos)/2)
+		if err := binary.Read(bytes.NewReader(ids), dbByteOrder, pl.ids); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(pos), dbByteOrder, pl.pos); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if rows, err = adb.db.Query(`SELECT ID FROM LookupFiles`); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id fileID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		t.files[id] = struct{}{}
+	}
+	return t, rows.Err()
+}
+
+// saveLookupTable saves the parts of t that have changed since it was loaded or saved.
+func (adb *audioDB) saveLookupTable(t *lookupTable) error {
+	tx, err := adb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after Commit()
+
+	if _, err := tx.Exec(`DELETE FROM LookupInfo`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO LookupInfo (Desc) VALUES(?)`, lookupTableDesc); err != nil {
+		return err
+	}
+
+	listStmt, err := tx.Prepare(`REPLACE INTO LookupLists (Key, IDs, Positions) VALUES(?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer listStmt.Close()
+	for key, dirty := range t.dirty {
+		if !dirty {
+			continue
+		}
+		pl := &t.lists[key]
+		var ids, pos bytes.Buffer
+		if err := binary.Write(&ids, dbByteOrder, pl.ids); err != nil {
+			return err
+		}
+		if err := binary.Write(&pos, dbByteOrder, pl.pos); err != nil {
+			return err
+		}
+		if _, err := listStmt.Exec(key, ids.Bytes(), pos.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	fileStmt, err := tx.Prepare(`REPLACE INTO LookupFiles (ID) VALUES(?)`)
+	if err != nil {
+		return err
+	}
+	defer fileStmt.Close()
+	for _, id := range t.unsaved {
+		if _, err := fileStmt.Exec(id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+	t.dirty = [len(t.dirty)]bool{}
+	t.unsaved = nil
+	return nil
 }
@@ -48,7 +48,7 @@ func TestAudioDB_Save_Get(t *testing.T) {
 		2835786340, 2835868260, 2836164325, 2903256545, 3976998131, 3976543474,
 		3980795026, 4156954754, 4135987330, 4135991426, 3532003458, 3532019842,
 	}
-	id, err := db.save(&fileInfo{0, path, size, dur, fprint})
+	id, err := db.save(&fileInfo{0, path, size, dur, fprint, false, nil})
 	if err != nil {
 		db.close()
 		t.Fatal("save failed: ", err)
@@ -63,7 +63,7 @@ func TestAudioDB_Save_Get(t *testing.T) {
 	}
 	defer db.close()
 
-	want := fileInfo{id, path, size, dur, fprint}
+	want := fileInfo{id, path, size, dur, fprint, false, nil}
 	if got, err := db.get(0, path); err != nil {
 		t.Errorf("get(0, %q) failed: %v", path, err)
 	} else if got == nil {
@@ -88,6 +88,25 @@ func TestAudioDB_Save_Get(t *testing.T) {
 	}
 }
 
+func TestAudioDB_Save_Get_Short(t *testing.T) {
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), defaultFpcalcSettings())
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	const path = "beep.wav"
+	id, err := db.save(&fileInfo{path: path, size: 1024, duration: 0.5, fprint: []uint32{1, 2}, short: true})
+	if err != nil {
+		t.Fatal("save failed: ", err)
+	}
+	if got, err := db.get(id, ""); err != nil {
+		t.Fatalf(`get(%d, "") failed: %v`, id, err)
+	} else if got == nil || !got.short {
+		t.Fatalf(`get(%d, "") = %+v; want short file`, id, got)
+	}
+}
+
 func TestAudioDB_ExcludedPairs(t *testing.T) {
 	p := filepath.Join(t.TempDir(), "test.db")
 	settings := defaultFpcalcSettings()
@@ -102,27 +121,148 @@ func TestAudioDB_ExcludedPairs(t *testing.T) {
 		c = "c.mp3"
 	)
 
-	if ok, err := db.isExcludedPair(a, b); err != nil {
-		t.Fatalf("isExcludedPair(%q, %q) failed: %v", a, b, err)
-	} else if ok {
-		t.Fatalf("isExcludedPair(%q, %q) = %v; want %v", a, b, ok, false)
+	check := func(pa, pb string, wantOK bool, wantTier string) {
+		t.Helper()
+		if ok, tier, err := db.getExcludedPair(pa, pb); err != nil {
+			t.Fatalf("getExcludedPair(%q, %q) failed: %v", pa, pb, err)
+		} else if ok != wantOK || tier != wantTier {
+			t.Fatalf("getExcludedPair(%q, %q) = %v, %q; want %v, %q", pa, pb, ok, tier, wantOK, wantTier)
+		}
 	}
-	if err := db.saveExcludedPair(a, b); err != nil {
+
+	check(a, b, false, "")
+	if err := db.saveExcludedPair(a, b, ""); err != nil {
 		t.Fatalf("saveExcludedPair(%q, %q) failed: %v", a, b, err)
 	}
-	if ok, err := db.isExcludedPair(a, b); err != nil {
-		t.Fatalf("isExcludedPair(%q, %q) failed: %v", a, b, err)
-	} else if !ok {
-		t.Fatalf("isExcludedPair(%q, %q) = %v; want %v", a, b, ok, true)
+	check(a, b, true, "")
+	check(b, a, true, "")
+	check(a, c, false, "")
+
+	const tier = "remaster"
+	if err := db.saveExcludedPair(c, a, tier); err != nil {
+		t.Fatalf("saveExcludedPair(%q, %q, %q) failed: %v", c, a, tier, err)
+	}
+	check(a, c, true, tier)
+}
+
+func TestAudioDB_LookupTable(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.db")
+	settings := defaultFpcalcSettings()
+	db, err := newAudioDB(p, settings)
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer func() { db.close() }()
+
+	// An empty table should be returned initially.
+	if table, err := db.loadLookupTable(); err != nil {
+		t.Fatal("loadLookupTable failed: ", err)
+	} else if len(table.files) != 0 {
+		t.Fatalf("loadLookupTable returned table with %d file(s); want 0", len(table.files))
+	}
+
+	fprints := map[fileID][]uint32{
+		1: {0x44442222, 0x44441111, 0x33332222, 0x55553333},
+		2: {0x44442222, 0x44442222, 0x44441111, 0x55553333},
+		3: {0x33332222, 0x33331111, 0x33334444, 0x44442222},
+	}
+	want := newLookupTable()
+	want.add(1, fprints[1], nil)
+	want.add(2, fprints[2], nil)
+	if err := db.saveLookupTable(want); err != nil {
+		t.Fatal("saveLookupTable failed: ", err)
+	}
+
+	// Reopen the database, load the table, and incrementally add another file.
+	if err := db.close(); err != nil {
+		t.Fatal("close failed: ", err)
 	}
-	if ok, err := db.isExcludedPair(b, a); err != nil {
-		t.Fatalf("isExcludedPair(%q, %q) failed: %v", b, a, err)
-	} else if !ok {
-		t.Fatalf("isExcludedPair(%q, %q) = %v; want %v", b, a, ok, true)
+	if db, err = newAudioDB(p, settings); err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	got, err := db.loadLookupTable()
+	if err != nil {
+		t.Fatal("loadLookupTable failed: ", err)
+	}
+	for _, id := range []fileID{1, 2, 3} {
+		if got.has(id) != want.has(id) {
+			t.Errorf("has(%d) = %v after load; want %v", id, got.has(id), want.has(id))
+		}
+	}
+	want.add(3, fprints[3], nil)
+	got.add(3, fprints[3], nil)
+	if err := db.saveLookupTable(got); err != nil {
+		t.Fatal("saveLookupTable failed: ", err)
+	}
+	if got, err = db.loadLookupTable(); err != nil {
+		t.Fatal("loadLookupTable failed: ", err)
+	}
+	if !reflect.DeepEqual(got.lists, want.lists) {
+		t.Error("Loaded lookup table lists differ from saved lists")
+	}
+	if !reflect.DeepEqual(got.files, want.files) {
+		t.Errorf("Loaded lookup table has files %v; want %v", got.files, want.files)
+	}
+}
+
+func TestAudioDB_ExtraFingerprint(t *testing.T) {
+	settings := defaultFpcalcSettings()
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), settings)
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	const path = "a.mp3"
+	full := *settings
+	full.length = 7200
+	if got, err := db.getExtraFingerprint(path, &full); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) failed: %v", path, err)
+	} else if got != nil {
+		t.Fatalf("getExtraFingerprint(%q) = %v; want nil", path, got)
+	}
+
+	fprint := []uint32{2835786340, 2835868260, 2836164325, 2903256545}
+	if err := db.saveExtraFingerprint(path, &full, fprint); err != nil {
+		t.Fatalf("saveExtraFingerprint(%q) failed: %v", path, err)
+	}
+	if got, err := db.getExtraFingerprint(path, &full); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) failed: %v", path, err)
+	} else if !reflect.DeepEqual(got, fprint) {
+		t.Fatalf("getExtraFingerprint(%q) = %v; want %v", path, got, fprint)
+	}
+
+	// Fingerprints computed with different settings are stored separately.
+	alg := *settings
+	alg.algorithm = 1
+	if got, err := db.getExtraFingerprint(path, &alg); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) with different settings failed: %v", path, err)
+	} else if got != nil {
+		t.Fatalf("getExtraFingerprint(%q) with different settings = %v; want nil", path, got)
+	}
+	fprint2 := []uint32{123, 456}
+	if err := db.saveExtraFingerprint(path, &alg, fprint2); err != nil {
+		t.Fatalf("saveExtraFingerprint(%q) with different settings failed: %v", path, err)
+	}
+	if got, err := db.getExtraFingerprint(path, &alg); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) with different settings failed: %v", path, err)
+	} else if !reflect.DeepEqual(got, fprint2) {
+		t.Fatalf("getExtraFingerprint(%q) with different settings = %v; want %v", path, got, fprint2)
+	}
+	if got, err := db.getExtraFingerprint(path, &full); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) failed: %v", path, err)
+	} else if !reflect.DeepEqual(got, fprint) {
+		t.Fatalf("getExtraFingerprint(%q) = %v; want %v", path, got, fprint)
+	}
+
+	// Empty fingerprints (e.g. for files too short for fpcalc) should also be saved.
+	const empty = "empty.mp3"
+	if err := db.saveExtraFingerprint(empty, &full, []uint32{}); err != nil {
+		t.Fatalf("saveExtraFingerprint(%q) with empty fingerprint failed: %v", empty, err)
 	}
-	if ok, err := db.isExcludedPair(a, c); err != nil {
-		t.Fatalf("isExcludedPair(%q, %q) failed: %v", a, c, err)
-	} else if ok {
-		t.Fatalf("isExcludedPair(%q, %q) = %v; want %v", a, c, ok, false)
+	if got, err := db.getExtraFingerprint(empty, &full); err != nil {
+		t.Fatalf("getExtraFingerprint(%q) failed: %v", empty, err)
+	} else if got == nil || len(got) != 0 {
+		t.Fatalf("getExtraFingerprint(%q) = %#v; want empty non-nil slice", empty, got)
 	}
 }
@@ -0,0 +1,91 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"path"
+	"sort"
+)
+
+// dirMatch describes a pair of directories (e.g. albums) containing duplicate files.
+type dirMatch struct {
+	a, b           string   // directory paths, with a < b
+	aFiles, bFiles int      // number of scanned files in each directory
+	aMissing       []string // files in b without duplicates in a
+	bMissing       []string // files in a without duplicates in b
+	coverage       float64  // fraction of files in a and b with duplicates in the other directory
+}
+
+// fileDir returns the directory containing p, a path reported by walkFiles.
+// Tracks from CUE sheets are in the directory containing their audio file.
+func fileDir(p string) string { return path.Dir(p) }
+
+// findDirMatches aggregates res.groups by the files' parent directories and returns
+// pairs of directories in which at least minCoverage of the files have duplicates in
+// the other directory. Duplicate files within the same directory are ignored.
+// The returned matches are sorted by descending coverage.
+func findDirMatches(res *scanResult, minCoverage float64) []*dirMatch {
+	dirPaths := make(map[string][]string) // dir -> scanned files
+	for _, p := range res.paths {
+		d := fileDir(p)
+		dirPaths[d] = append(dirPaths[d], p)
+	}
+
+	type dirPair struct{ a, b string }
+	dups := make(map[dirPair]map[string]struct{}) // paths with duplicates in the other dir
+	for _, g := range res.groups {
+		for i, fa := range g.files {
+			for _, fb := range g.files[i+1:] {
+				da, db := fileDir(fa.path), fileDir(fb.path)
+				if da == db {
+					continue
+				}
+				if db < da {
+					da, db = db, da
+				}
+				pair := dirPair{da, db}
+				if dups[pair] == nil {
+					dups[pair] = make(map[string]struct{})
+				}
+				dups[pair][fa.path] = struct{}{}
+				dups[pair][fb.path] = struct{}{}
+			}
+		}
+	}
+
+	var matches []*dirMatch
+	for pair, paths := range dups {
+		m := &dirMatch{a: pair.a, b: pair.b, aFiles: len(dirPaths[pair.a]), bFiles: len(dirPaths[pair.b])}
+		if total := m.aFiles + m.bFiles; total > 0 {
+			m.coverage = float64(len(paths)) / float64(total)
+		}
+		if m.coverage < minCoverage {
+			continue
+		}
+		for _, p := range dirPaths[m.a] {
+			if _, ok := paths[p]; !ok {
+				m.bMissing = append(m.bMissing, p)
+			}
+		}
+		for _, p := range dirPaths[m.b] {
+			if _, ok := paths[p]; !ok {
+				m.aMissing = append(m.aMissing, p)
+			}
+		}
+		sort.Strings(m.aMissing)
+		sort.Strings(m.bMissing)
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		mi, mj := matches[i], matches[j]
+		if mi.coverage != mj.coverage {
+			return mi.coverage > mj.coverage
+		}
+		if mi.a != mj.a {
+			return mi.a < mj.a
+		}
+		return mi.b < mj.b
+	})
+	return matches
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindDirMatches(t *testing.T) {
+	infos := make(map[string]*fileInfo)
+	get := func(p string) *fileInfo {
+		if infos[p] == nil {
+			infos[p] = &fileInfo{path: p}
+		}
+		return infos[p]
+	}
+	res := &scanResult{
+		groups: []*group{
+			{files: []*fileInfo{get("a/1.mp3"), get("b/01.mp3")}},
+			{files: []*fileInfo{get("a/2.mp3"), get("b/02.mp3"), get("c/2.mp3")}},
+			{files: []*fileInfo{get("a/3.mp3"), get("b/03.mp3")}},
+			{files: []*fileInfo{get("c/4.mp3"), get("c/4 copy.mp3")}},
+		},
+		paths: []string{
+			"a/1.mp3", "a/2.mp3", "a/3.mp3", "a/4.mp3",
+			"b/01.mp3", "b/02.mp3", "b/03.mp3",
+			"c/2.mp3", "c/4.mp3", "c/4 copy.mp3", "c/5.mp3",
+		},
+	}
+
+	want := []*dirMatch{{
+		a: "a", b: "b", aFiles: 4, bFiles: 3,
+		bMissing: []string{"a/4.mp3"},
+		coverage: 6.0 / 7,
+	}}
+	if got := findDirMatches(res, 0.5); !reflect.DeepEqual(got, want) {
+		t.Errorf("findDirMatches(..., 0.5) = %+v; want %+v", got, want)
+	}
+
+	// Lowering the threshold should also report the pairs involving c.
+	got := findDirMatches(res, 0.1)
+	var pairs [][2]string
+	for _, m := range got {
+		pairs = append(pairs, [2]string{m.a, m.b})
+	}
+	if want := [][2]string{{"a", "b"}, {"b", "c"}, {"a", "c"}}; !reflect.DeepEqual(pairs, want) {
+		t.Errorf("findDirMatches(..., 0.1) returned %q; want %q", pairs, want)
+	}
+}
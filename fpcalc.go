@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -19,8 +21,17 @@ type fpcalcSettings struct {
 	chunk     float64 // "-chunk SECS    Split the input audio into chunks of this duration"
 	algorithm int     // "-algorithm NUM Set the algorithm method (default 2)"
 	overlap   bool    // "-overlap       Overlap the chunks slightly to make sure audio on the edges is fingerprinted"
+	ensemble  []int   // additional algorithms used to score matches (see scanOptions.ensembleCombine)
 }
 
+// fingerprintRate is the approximate number of fingerprint values per second of audio.
+// Chromaprint resamples audio to 11025 Hz and advances by a third of its 4096-sample
+// frames for each value.
+const fingerprintRate = 11025.0 / (4096 / 3)
+
+// secondsToValues converts sec seconds of audio to the nearest number of fingerprint values.
+func secondsToValues(sec float64) int { return int(math.Round(sec * fingerprintRate)) }
+
 func defaultFpcalcSettings() *fpcalcSettings {
 	return &fpcalcSettings{
 		length:    15,
@@ -31,8 +42,41 @@ func defaultFpcalcSettings() *fpcalcSettings {
 }
 
 func (s *fpcalcSettings) String() string {
-	return fmt.Sprintf("length=%0.3f,chunk=%0.3f,algorithm=%d,overlap=%v",
+	str := fmt.Sprintf("length=%0.3f,chunk=%0.3f,algorithm=%d,overlap=%v",
 		s.length, s.chunk, s.algorithm, s.overlap)
+	// Only include the ensemble when it's set so that existing databases still match.
+	if len(s.ensemble) > 0 {
+		algs := make([]string, len(s.ensemble))
+		for i, alg := range s.ensemble {
+			algs[i] = strconv.Itoa(alg)
+		}
+		str += ",ensemble=" + strings.Join(algs, "+")
+	}
+	return str
+}
+
+// withAlgorithm returns a copy of s that uses the supplied algorithm and no ensemble.
+func (s *fpcalcSettings) withAlgorithm(alg int) *fpcalcSettings {
+	c := *s
+	c.algorithm = alg
+	c.ensemble = nil
+	return &c
+}
+
+// parseAlgorithms parses a comma-separated list of fingerprint algorithms.
+func parseAlgorithms(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var algs []int
+	for _, str := range strings.Split(s, ",") {
+		alg, err := strconv.Atoi(str)
+		if err != nil || alg < 0 {
+			return nil, fmt.Errorf("bad algorithm %q", str)
+		}
+		algs = append(algs, alg)
+	}
+	return algs, nil
 }
 
 // haveFpcalc returns false if fpcalc isn't in $PATH.
@@ -68,6 +112,16 @@ var errEmptyFingerprint = errors.New("empty fingerprint")
 
 // runFpcalc runs fpcalc to compute a fingerprint for path per settings.
 func runFpcalc(path string, settings *fpcalcSettings) (*fpcalcResult, error) {
+	return execFpcalc(path, nil, settings)
+}
+
+// runFpcalcReader is like runFpcalc but reads audio data from r.
+func runFpcalcReader(r io.Reader, settings *fpcalcSettings) (*fpcalcResult, error) {
+	return execFpcalc("-", r, settings)
+}
+
+// execFpcalc runs fpcalc against path (or stdin if path is "-").
+func execFpcalc(path string, stdin io.Reader, settings *fpcalcSettings) (*fpcalcResult, error) {
 	args := []string{
 		"-raw",
 		"-json",
@@ -82,7 +136,9 @@ func runFpcalc(path string, settings *fpcalcSettings) (*fpcalcResult, error) {
 	}
 	args = append(args, path)
 
-	out, err := exec.Command("fpcalc", args...).Output()
+	cmd := exec.Command("fpcalc", args...)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
 	if err != nil {
 		// Try to get some additional info from stderr.
 		if exit, ok := err.(*exec.ExitError); ok {
@@ -101,3 +157,65 @@ func runFpcalc(path string, settings *fpcalcSettings) (*fpcalcResult, error) {
 	}
 	return &res, nil
 }
+
+// shortClipLength is the duration in seconds that runFpcalcLooped loops audio to.
+const shortClipLength = 10
+
+// haveFfmpeg returns false if ffmpeg or ffprobe isn't in $PATH.
+func haveFfmpeg() bool {
+	for _, prog := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(prog); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runFpcalcLooped is like runFpcalc, but it uses ffmpeg to repeat path's audio
+// until it's shortClipLength seconds long. This permits fingerprinting files that
+// are too short for Chromaprint. The returned duration is path's actual duration.
+func runFpcalcLooped(path string, settings *fpcalcSettings) (*fpcalcResult, error) {
+	dur, err := getDuration(path)
+	if err != nil {
+		return nil, err
+	} else if dur <= 0 {
+		return nil, errEmptyFingerprint
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-v", "error", "-stream_loop", "-1", "-i", path,
+		"-t", strconv.Itoa(shortClipLength), "-f", "wav", "-")
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	res, err := runFpcalcReader(out, settings)
+	out.Close() // unblock ffmpeg if fpcalc stopped reading early
+	// ffmpeg may fail due to fpcalc not reading all of its output, so only report
+	// its error if fpcalc also failed.
+	if werr := cmd.Wait(); err != nil {
+		if werr != nil {
+			err = fmt.Errorf("%v (ffmpeg: %v %q)", err, werr, strings.Split(stderr.String(), "\n")[0])
+		}
+		return nil, err
+	}
+	res.Duration = dur
+	return res, nil
+}
+
+// getDuration uses ffprobe to get the duration of path in seconds.
+func getDuration(path string) (float64, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %v (%q)", err, strings.Split(stderr.String(), "\n")[0])
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFpcalcSettings_String(t *testing.T) {
+	s := defaultFpcalcSettings()
+	const want = "length=15.000,chunk=0.000,algorithm=2,overlap=false"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q; want %q", got, want)
+	}
+	s.ensemble = []int{1, 4}
+	if got := s.String(); got != want+",ensemble=1+4" {
+		t.Errorf("String() with ensemble = %q; want %q", got, want+",ensemble=1+4")
+	}
+	if got := s.withAlgorithm(4).String(); got != "length=15.000,chunk=0.000,algorithm=4,overlap=false" {
+		t.Errorf("withAlgorithm(4).String() = %q", got)
+	}
+}
+
+func TestParseAlgorithms(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		want  []int
+		valid bool
+	}{
+		{"", nil, true},
+		{"1", []int{1}, true},
+		{"1,4", []int{1, 4}, true},
+		{"1,", nil, false},
+		{"a", nil, false},
+		{"-1", nil, false},
+	} {
+		got, err := parseAlgorithms(tc.in)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("parseAlgorithms(%q) unexpectedly succeeded", tc.in)
+			}
+		} else if err != nil {
+			t.Errorf("parseAlgorithms(%q) failed: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseAlgorithms(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/derat/soundalike
 
-go 1.15
+go 1.16
 
 require github.com/mattn/go-sqlite3 v1.14.11
@@ -0,0 +1,145 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ignoreFile is the name of files listing gitignore-style patterns of paths
+// to skip within their directories.
+const ignoreFile = ".soundalikeignore"
+
+// ignoreRule is a single gitignore-style pattern.
+type ignoreRule struct {
+	re      *regexp.Regexp // matches slash-separated paths relative to the rule's directory
+	negate  bool           // pattern started with '!', so matching paths aren't skipped
+	dirOnly bool           // pattern ended with '/', so only directories are matched
+}
+
+// parseIgnoreRule parses a single line from an ignoreFile.
+// Patterns without slashes (other than a trailing one) match names at any depth,
+// while other patterns are relative to the rule's directory. "*", "?", "[...]",
+// and "**" are supported. false is returned for blank lines and comments.
+func parseIgnoreRule(ln string) (ignoreRule, bool, error) {
+	var rule ignoreRule
+	ln = strings.TrimRight(ln, " \t\r")
+	if ln == "" || ln[0] == '#' {
+		return rule, false, nil
+	}
+	if ln[0] == '!' {
+		rule.negate = true
+		ln = ln[1:]
+	}
+	if strings.HasSuffix(ln, "/") {
+		rule.dirOnly = true
+		ln = strings.TrimRight(ln, "/")
+	}
+	if ln == "" {
+		return rule, false, fmt.Errorf("empty pattern")
+	}
+	expr := "^"
+	if strings.Contains(ln, "/") {
+		ln = strings.TrimPrefix(ln, "/")
+	} else {
+		expr += "(?:.*/)?"
+	}
+	expr += globToRegexp(ln) + "$"
+	var err error
+	if rule.re, err = regexp.Compile(expr); err != nil {
+		return rule, false, fmt.Errorf("bad pattern %q", ln)
+	}
+	return rule, true, nil
+}
+
+// globToRegexp converts glob to a regular expression (without anchors).
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
+
+// parseIgnoreRules parses the rules in an ignoreFile read from r.
+func parseIgnoreRules(r io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		rule, ok, err := parseIgnoreRule(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		} else if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// matchIgnoreRules checks rel (a directory if isDir is true) against rules.
+// The last matching rule determines whether rel is ignored. matched is false
+// if no rules matched.
+func matchIgnoreRules(rules []ignoreRule, rel string, isDir bool) (ignored, matched bool) {
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored, matched = !r.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// ancestorDirs returns the directories containing p, a slash-separated path,
+// starting with ".".
+func ancestorDirs(p string) []string {
+	dirs := []string{"."}
+	parts := strings.Split(path.Dir(p), "/")
+	for i := range parts {
+		if d := strings.Join(parts[:i+1], "/"); d != "." {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
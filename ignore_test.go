@@ -0,0 +1,64 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchIgnoreRules(t *testing.T) {
+	rules, err := parseIgnoreRules(strings.NewReader(`# comment
+*.wav
+!keep.wav
+Podcasts/
+/_incoming
+a/**/b
+[!x]y?.mp3
+\#hash.mp3
+`))
+	if err != nil {
+		t.Fatal("parseIgnoreRules failed: ", err)
+	}
+	for _, tc := range []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"song.wav", false, true},
+		{"dir/song.wav", false, true},
+		{"keep.wav", false, false},
+		{"dir/keep.wav", false, false},
+		{"song.mp3", false, false},
+		{"Podcasts", true, true},
+		{"dir/Podcasts", true, true},
+		{"Podcasts", false, false},
+		{"_incoming", true, true},
+		{"_incoming", false, true},
+		{"dir/_incoming", true, false},
+		{"a/b", true, true},
+		{"a/x/y/b", true, true},
+		{"x/a/b", true, false},
+		{"ayz.mp3", false, true},
+		{"xyz.mp3", false, false},
+		{"#hash.mp3", false, true},
+	} {
+		if got, _ := matchIgnoreRules(rules, tc.rel, tc.isDir); got != tc.want {
+			t.Errorf("matchIgnoreRules(..., %q, %v) = %v; want %v", tc.rel, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestAncestorDirs(t *testing.T) {
+	for p, want := range map[string][]string{
+		"a.mp3":       {"."},
+		"a/b.mp3":     {".", "a"},
+		"a/b/c/d.mp3": {".", "a", "a/b", "a/b/c"},
+	} {
+		if got := ancestorDirs(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("ancestorDirs(%q) = %q; want %q", p, got, want)
+		}
+	}
+}
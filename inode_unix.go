@@ -0,0 +1,21 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileDevIno returns the device and inode numbers from fi.
+func fileDevIno(fi fs.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
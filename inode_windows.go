@@ -0,0 +1,9 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import "io/fs"
+
+// fileDevIno returns false, since inode numbers aren't available via fs.FileInfo on Windows.
+func fileDevIno(fi fs.FileInfo) (dev, ino uint64, ok bool) { return 0, 0, false }
@@ -3,59 +3,291 @@
 
 package main
 
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// lookupTableDesc describes lookupTable's format. It's saved alongside tables in
+// audioDB so that tables saved in a different format can be discarded.
+const lookupTableDesc = "key=top16,value=positions"
+
+// maxKeyHits is the maximum number of hits that lookupTable.find will produce for
+// a single key. Values that appear many times in the query and in the table (e.g.
+// silence) would otherwise make find quadratic in both time and memory.
+const maxKeyHits = 1 << 16
+
+// candidateFinder is used to quickly find approximate matches for a given fingerprint.
+type candidateFinder interface {
+	// add adds the supplied file. Positions where mask (which may be nil) is true are skipped.
+	add(id fileID, fprint []uint32, mask []bool)
+	// has returns true if the specified file has been added.
+	has(id fileID) bool
+	// find returns files that share at least thresh keys with fprint at a consistent offset.
+	// Positions where mask (which may be nil) is true are skipped.
+	find(fprint []uint32, mask []bool, thresh int) []candidate
+}
+
+// candidate describes a file returned by candidateFinder.find.
+type candidate struct {
+	id     fileID
+	offset int // position in file's fingerprint minus position in query fingerprint
+	votes  int // number of keys shared with query fingerprint at offset
+}
+
 // lookupTable is used to quickly find approximate matches for a given fingerprint.
-// 32-bit fingerprint values are truncated to 16 bits to conserve space.
+// 32-bit fingerprint values are truncated to 16-bit keys to conserve space.
+// By default, the top 16 bits of each value are used.
+//
+// The table is an inverted index containing a posting list for each truncated value.
+// Per-value maps were previously used, but they consumed many gigabytes of memory
+// for libraries with millions of files.
 type lookupTable struct {
-	m map[uint16]map[fileID]int16 // truncated fingerprint value -> file -> count
+	key     func(uint32) uint16  // truncates a fingerprint value to a key
+	lists   [1 << 16]postingList // indexed by key
+	files   map[fileID]struct{}  // files that have been added
+	unsaved []fileID             // files added since the table was loaded or saved
+	dirty   [1 << 16]bool        // lists modified since the table was loaded or saved
+}
+
+// postingList lists the occurrences of a key within files' fingerprints.
+// Entries are sorted by ascending file ID and then by ascending position.
+type postingList struct {
+	ids []fileID
+	pos []uint16 // position of key within ids[i]'s fingerprint
+}
+
+func newLookupTable() *lookupTable { return newLookupTableWithKey(prefixKey) }
+
+func newLookupTableWithKey(key func(uint32) uint16) *lookupTable {
+	return &lookupTable{key: key, files: make(map[fileID]struct{})}
 }
 
-func newLookupTable() *lookupTable { return &lookupTable{make(map[uint16]map[fileID]int16)} }
+// prefixKey returns the top 16 bits of v.
+func prefixKey(v uint32) uint16 { return uint16(v >> 16) }
 
 // add adds the supplied file to the table.
-func (t *lookupTable) add(id fileID, fprint []uint32) {
-	for _, v := range fprint {
-		key := uint16(v >> 16)
-		counts := t.m[key]
-		if counts == nil {
-			counts = make(map[fileID]int16)
-			t.m[key] = counts
-		}
-		counts[id]++
-	}
-}
-
-// find returns files that share at least thresh truncated values with fprint.
-func (t *lookupTable) find(fprint []uint32, thresh int) []fileID {
-	// For each file, maintain a map from truncated fingerprint value to the
-	// number of hits we've had so far. This makes sure that we don't overcount
-	// the number of hits: if fprint contains two copies of value 4 but 4 only
-	// appears once in a given file, we don't want to double-count it.
-	hits := make(map[fileID]map[uint16]int16)
-
-	for _, v := range fprint {
-		key := uint16(v >> 16)
-		for id, cnt := range t.m[key] {
-			if seen := hits[id][key]; seen < cnt {
-				m := hits[id]
-				if m == nil {
-					m = make(map[uint16]int16)
-					hits[id] = m
-				}
-				m[key]++
+// Values past the first 65536 in fprint and values where mask is true are ignored.
+func (t *lookupTable) add(id fileID, fprint []uint32, mask []bool) {
+	if len(fprint) > math.MaxUint16+1 {
+		fprint = fprint[:math.MaxUint16+1]
+	}
+	kps := sortKeys(fprint, mask, t.key)
+	pos := make([]uint16, 0, len(kps))
+	for i, kp := range kps {
+		pos = append(pos, uint16(kp.pos))
+		if i == len(kps)-1 || kps[i+1].key != kp.key {
+			t.lists[kp.key].insert(id, pos)
+			t.dirty[kp.key] = true
+			pos = pos[:0]
+		}
+	}
+	if _, ok := t.files[id]; !ok {
+		t.files[id] = struct{}{}
+		t.unsaved = append(t.unsaved, id)
+	}
+}
+
+// has returns true if the specified file has been added to the table.
+func (t *lookupTable) has(id fileID) bool {
+	_, ok := t.files[id]
+	return ok
+}
+
+// find returns files that share at least thresh truncated values with fprint at
+// the same offset. Each hit votes for the offset between its positions in the file
+// and in fprint, and the offset with the most votes is returned for each file.
+// This prevents files that share common values at random positions from matching.
+// Values where mask is true are ignored.
+//
+// Keys that would produce more than maxKeyHits hits (e.g. silence) are also ignored,
+// and thresh is reduced in proportion to the number of skipped values.
+func (t *lookupTable) find(fprint []uint32, mask []bool, thresh int) []candidate {
+	// Pack each hit's file ID and offset into a single value so they can be sorted
+	// cheaply. The ID goes in the upper bits so hits will be grouped by file.
+	const bias = 1 << 31
+	var hits []uint64
+	kps := sortKeys(fprint, mask, t.key)
+	var skipped int
+	for i := 0; i < len(kps); {
+		j := i + 1
+		for j < len(kps) && kps[j].key == kps[i].key {
+			j++
+		}
+		pl := &t.lists[kps[i].key]
+		if (j-i)*len(pl.ids) > maxKeyHits {
+			skipped += j - i
+			i = j
+			continue
+		}
+		for _, kp := range kps[i:j] {
+			for k, id := range pl.ids {
+				off := int64(pl.pos[k]) - int64(kp.pos)
+				hits = append(hits, uint64(id)<<32|uint64(off+bias))
 			}
 		}
+		i = j
 	}
+	if skipped > 0 {
+		thresh = thresh * (len(kps) - skipped) / len(kps)
+	}
+	sort.Sort(uint64Slice(hits))
+
+	// Each run of identical values contains the votes for an offset within a file.
+	var cands []candidate
+	var best candidate
+	for i := 0; i < len(hits); {
+		j := i + 1
+		for j < len(hits) && hits[j] == hits[i] {
+			j++
+		}
+		id := fileID(hits[i] >> 32)
+		if id != best.id {
+			if best.votes >= thresh {
+				cands = append(cands, best)
+			}
+			best = candidate{id: id}
+		}
+		if votes := j - i; votes > best.votes {
+			best.offset = int(int64(hits[i]&math.MaxUint32) - bias)
+			best.votes = votes
+		}
+		i = j
+	}
+	if best.id != 0 && best.votes >= thresh {
+		cands = append(cands, best)
+	}
+	return cands
+}
 
-	// Sum the hits for each file and keep the ones that reached the threshold.
-	ids := make([]fileID, 0, len(hits))
-	for id, m := range hits {
-		var cnt int
-		for _, v := range m {
-			cnt += int(v)
+// insert adds entries for id at the supplied ascending positions.
+// If id is already present, its existing entries are replaced.
+func (pl *postingList) insert(id fileID, pos []uint16) {
+	// Files are usually added in ascending order, so check the end of the list first.
+	n := len(pl.ids)
+	if n == 0 || pl.ids[n-1] < id {
+		for _, p := range pos {
+			pl.ids = append(pl.ids, id)
+			pl.pos = append(pl.pos, p)
 		}
-		if cnt >= thresh {
-			ids = append(ids, id)
+		return
+	}
+
+	// Otherwise, rebuild the list with the new entries in the proper location.
+	start := sort.Search(n, func(i int) bool { return pl.ids[i] >= id })
+	end := start
+	for end < n && pl.ids[end] == id {
+		end++
+	}
+	ids := make([]fileID, 0, n-(end-start)+len(pos))
+	ids = append(ids, pl.ids[:start]...)
+	for range pos {
+		ids = append(ids, id)
+	}
+	pl.ids = append(ids, pl.ids[end:]...)
+	ps := make([]uint16, 0, cap(ids))
+	ps = append(ps, pl.pos[:start]...)
+	ps = append(ps, pos...)
+	pl.pos = append(ps, pl.pos[end:]...)
+}
+
+// keyPos holds a truncated value and its position within a fingerprint.
+type keyPos struct {
+	key uint16
+	pos int
+}
+
+// sortKeys uses key to truncate the values in fprint and returns the truncated
+// values and their positions, sorted by ascending value and then by ascending position.
+// Values where mask (which may be nil) is true are omitted.
+func sortKeys(fprint []uint32, mask []bool, key func(uint32) uint16) []keyPos {
+	kps := make([]keyPos, 0, len(fprint))
+	for i, v := range fprint {
+		if !isMasked(mask, i) {
+			kps = append(kps, keyPos{key(v), i})
+		}
+	}
+	// Perform a radix sort on the keys a byte at a time. Each pass is stable,
+	// so positions remain in ascending order.
+	tmp := make([]keyPos, len(kps))
+	for shift := uint(0); shift < 16; shift += 8 {
+		var starts [257]int
+		for _, kp := range kps {
+			starts[(kp.key>>shift)&0xff+1]++
+		}
+		for i := 1; i < len(starts); i++ {
+			starts[i] += starts[i-1]
+		}
+		for _, kp := range kps {
+			b := (kp.key >> shift) & 0xff
+			tmp[starts[b]] = kp
+			starts[b]++
+		}
+		kps, tmp = tmp, kps
+	}
+	return kps
+}
+
+// uint64Slice implements sort.Interface for sorting uint64 values in ascending order.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// lshTable is a candidateFinder that uses locality-sensitive hashing.
+// Each of its lookupTables uses a different pseudorandom subset of each fingerprint
+// value's bits as the key, so values with a few flipped bits will still collide
+// in the tables that don't use the flipped bits. lshTable also helps when values
+// share common top bits, since those values won't share keys in other tables.
+type lshTable struct {
+	tables []*lookupTable
+}
+
+// newLSHTable returns an lshTable with ntables tables using nbits bits each.
+// nbits must be in [1, 16].
+func newLSHTable(ntables, nbits int) *lshTable {
+	tables := make([]*lookupTable, ntables)
+	for i := range tables {
+		// Use a fixed seed for each table so results are repeatable.
+		pos := rand.New(rand.NewSource(int64(i))).Perm(32)[:nbits]
+		sort.Ints(pos)
+		tables[i] = newLookupTableWithKey(func(v uint32) uint16 {
+			var key uint16
+			for j, p := range pos {
+				key |= uint16((v>>uint(p))&1) << uint(j)
+			}
+			return key
+		})
+	}
+	return &lshTable{tables}
+}
+
+func (t *lshTable) add(id fileID, fprint []uint32, mask []bool) {
+	for _, tab := range t.tables {
+		tab.add(id, fprint, mask)
+	}
+}
+
+func (t *lshTable) has(id fileID) bool {
+	return len(t.tables) > 0 && t.tables[0].has(id)
+}
+
+// find returns files that share at least thresh keys with fprint in any of t's tables.
+// If a file is found in multiple tables, the offset with the most votes is used.
+func (t *lshTable) find(fprint []uint32, mask []bool, thresh int) []candidate {
+	found := make(map[fileID]int) // index into cands
+	var cands []candidate
+	for _, tab := range t.tables {
+		for _, c := range tab.find(fprint, mask, thresh) {
+			if i, ok := found[c.id]; !ok {
+				found[c.id] = len(cands)
+				cands = append(cands, c)
+			} else if c.votes > cands[i].votes {
+				cands[i] = c
+			}
 		}
 	}
-	return ids
+	return cands
 }
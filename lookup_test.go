@@ -4,7 +4,10 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
+	"runtime"
 	"sort"
 	"testing"
 )
@@ -19,30 +22,202 @@ func TestLookupTable(t *testing.T) {
 		{2, []uint32{0x44442222, 0x44442222, 0x44441111, 0x55553333}},
 		{3, []uint32{0x33332222, 0x33331111, 0x33334444, 0x44442222}},
 	} {
-		table.add(f.id, f.fprint)
+		table.add(f.id, f.fprint, nil)
 	}
 
 	for _, tc := range []struct {
 		fprint []uint32
 		thresh int
-		want   []fileID
+		want   []candidate
 	}{
-		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 4, []fileID{1}},
-		{[]uint32{0x44441111, 0x44448888, 0x33331111, 0x55551111}, 4, []fileID{1}},
-		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 3, []fileID{1, 2}},
-		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 2, []fileID{1, 2, 3}},
-		{[]uint32{0x44442222, 0x44442222, 0x44442222, 0x44442222}, 4, []fileID{}},
-		{[]uint32{0x44442222, 0x44442222, 0x44442222, 0x44442222}, 3, []fileID{2}},
-		{[]uint32{0x99999999, 0x99999999, 0x99999999, 0x99999999}, 1, []fileID{}},
-		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 4, []fileID{}},
-		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 3, []fileID{3}},
-		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 2, []fileID{3}},
-		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 1, []fileID{1, 3}},
+		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 4, []candidate{{1, 0, 4}}},
+		{[]uint32{0x44441111, 0x44448888, 0x33331111, 0x55551111}, 4, []candidate{{1, 0, 4}}},
+		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 3, []candidate{{1, 0, 4}, {2, 0, 3}}},
+		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 2, []candidate{{1, 0, 4}, {2, 0, 3}}},
+		{[]uint32{0x44442222, 0x44441111, 0x33332222, 0x55553333}, 1, []candidate{{1, 0, 4}, {2, 0, 3}, {3, -2, 1}}},
+		{[]uint32{0x00000000, 0x44442222, 0x44441111, 0x33332222, 0x55553333}, 4, []candidate{{1, -1, 4}}},
+		{[]uint32{0x44442222, 0x44442222, 0x44442222, 0x44442222}, 4, nil},
+		{[]uint32{0x44442222, 0x44442222, 0x44442222, 0x44442222}, 3, []candidate{{2, -1, 3}}},
+		{[]uint32{0x99999999, 0x99999999, 0x99999999, 0x99999999}, 1, nil},
+		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 4, nil},
+		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 3, []candidate{{3, -1, 3}}},
+		{[]uint32{0x33333333, 0x33333333, 0x33333333, 0x33333333}, 1, []candidate{{1, -1, 1}, {3, -1, 3}}},
 	} {
-		got := table.find(tc.fprint, tc.thresh)
-		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		got := table.find(tc.fprint, nil, tc.thresh)
+		sort.Slice(got, func(i, j int) bool { return got[i].id < got[j].id })
 		if !reflect.DeepEqual(got, tc.want) {
 			t.Errorf("find(%v, %d) = %v; want %v", tc.fprint, tc.thresh, got, tc.want)
 		}
 	}
 }
+
+func TestLookupTable_CommonKeys(t *testing.T) {
+	// Add enough files starting with silence that the zero key is skipped.
+	table := newLookupTable()
+	n := maxKeyHits/2 + 1
+	for i := 0; i < n; i++ {
+		table.add(fileID(i+1), []uint32{0, 0, uint32(i) << 16}, nil)
+	}
+	id := fileID(n + 1)
+	fprint := []uint32{0, 0, 0x44442222, 0x44441111, 0x33332222, 0x55553333}
+	table.add(id, fprint, nil)
+
+	// The thresh of 6 should be reduced to 4 to account for the skipped silence.
+	if got, want := table.find(fprint, nil, len(fprint)), []candidate{{id, 0, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find(%v, %d) = %v; want %v", fprint, len(fprint), got, want)
+	}
+}
+
+// mapLookupTable is the original map-based implementation of lookupTable.
+// It's used as a baseline for benchmarks. Masks are ignored.
+type mapLookupTable struct {
+	m map[uint16]map[fileID]int16 // truncated fingerprint value -> file -> count
+}
+
+func (t *mapLookupTable) add(id fileID, fprint []uint32, mask []bool) {
+	for _, v := range fprint {
+		key := uint16(v >> 16)
+		counts := t.m[key]
+		if counts == nil {
+			counts = make(map[fileID]int16)
+			t.m[key] = counts
+		}
+		counts[id]++
+	}
+}
+
+func (t *mapLookupTable) find(fprint []uint32, mask []bool, thresh int) []fileID {
+	hits := make(map[fileID]map[uint16]int16)
+	for _, v := range fprint {
+		key := uint16(v >> 16)
+		for id, cnt := range t.m[key] {
+			if seen := hits[id][key]; seen < cnt {
+				m := hits[id]
+				if m == nil {
+					m = make(map[uint16]int16)
+					hits[id] = m
+				}
+				m[key]++
+			}
+		}
+	}
+	ids := make([]fileID, 0, len(hits))
+	for id, m := range hits {
+		var cnt int
+		for _, v := range m {
+			cnt += int(v)
+		}
+		if cnt >= thresh {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// benchFingerprints returns n pseudorandom fingerprints with roughly the length
+// of 15-second fingerprints. Each fingerprint starts with silence zero values.
+func benchFingerprints(n, silence int) [][]uint32 {
+	const length = 120
+	r := rand.New(rand.NewSource(int64(n)))
+	fprints := make([][]uint32, n)
+	for i := range fprints {
+		fprints[i] = make([]uint32, length)
+		for j := silence; j < length; j++ {
+			fprints[i][j] = r.Uint32()
+		}
+	}
+	return fprints
+}
+
+// heapAlloc returns the number of bytes currently allocated on the heap.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// BenchmarkLookupTable reports find latency and memory consumption for lookupTable
+// and mapLookupTable. Note that mapLookupTable uses many gigabytes with 1M files.
+// The "silence" cases check that repeated values don't make find quadratic.
+func BenchmarkLookupTable(b *testing.B) {
+	type table interface {
+		add(fileID, []uint32, []bool)
+	}
+	for _, bc := range []struct{ n, silence int }{
+		{100_000, 0},
+		{1_000_000, 0},
+		{100_000, 10},
+	} {
+		var fprints [][]uint32
+		for _, impl := range []struct {
+			name   string
+			create func() table
+		}{
+			{"map", func() table { return &mapLookupTable{make(map[uint16]map[fileID]int16)} }},
+			{"postings", func() table { return newLookupTable() }},
+		} {
+			var t table
+			var mb float64
+			name := fmt.Sprintf("%s/%d", impl.name, bc.n)
+			if bc.silence > 0 {
+				name += fmt.Sprintf("/silence=%d", bc.silence)
+			}
+			b.Run(name, func(b *testing.B) {
+				// b.Run may call this function multiple times, so only build the table once.
+				if t == nil {
+					if fprints == nil {
+						fprints = benchFingerprints(bc.n, bc.silence)
+					}
+					before := heapAlloc()
+					t = impl.create()
+					for i, fp := range fprints {
+						t.add(fileID(i+1), fp, nil)
+					}
+					mb = float64(heapAlloc()-before) / (1 << 20)
+					b.ResetTimer()
+				}
+				for i := 0; i < b.N; i++ {
+					fp := fprints[i%len(fprints)]
+					switch t := t.(type) {
+					case *mapLookupTable:
+						t.find(fp, nil, len(fp)/4)
+					case *lookupTable:
+						t.find(fp, nil, len(fp)/4)
+					}
+				}
+				b.ReportMetric(mb, "MB")
+			})
+		}
+	}
+}
+
+func TestLSHTable(t *testing.T) {
+	fprint := []uint32{0x12345678, 0x9abcdef0, 0x0fedcba9, 0x87654321}
+	var flipped []uint32 // flip a bit in the top half of each value
+	for i, v := range fprint {
+		flipped = append(flipped, v^(1<<uint(16+i)))
+	}
+	other := []uint32{0xffff0000, 0x0000ffff, 0xf0f0f0f0, 0x0f0f0f0f}
+
+	lookup := newLookupTable()
+	lookup.add(1, fprint, nil)
+	lookup.add(2, other, nil)
+	if got := lookup.find(flipped, nil, 1); len(got) != 0 {
+		t.Errorf("lookupTable.find(%v, 1) = %v; want []", flipped, got)
+	}
+
+	lsh := newLSHTable(8, 8)
+	lsh.add(1, fprint, nil)
+	lsh.add(2, other, nil)
+	if !lsh.has(1) || !lsh.has(2) || lsh.has(3) {
+		t.Errorf("has returned (%v, %v, %v) for 1, 2, 3; want (true, true, false)",
+			lsh.has(1), lsh.has(2), lsh.has(3))
+	}
+	if got, want := lsh.find(flipped, nil, len(flipped)), []candidate{{1, 0, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lshTable.find(%v, %d) = %v; want %v", flipped, len(flipped), got, want)
+	}
+	if got, want := lsh.find(fprint, nil, len(fprint)), []candidate{{1, 0, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lshTable.find(%v, %d) = %v; want %v", fprint, len(fprint), got, want)
+	}
+}
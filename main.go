@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/bits"
 	"os"
 	"os/exec"
@@ -23,29 +24,86 @@ func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), "Usage: soundalike [flag]... <DIR>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       soundalike -db <DB> -query [flag]... <FILE>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       soundalike -db <DB> -add-segments [flag]... <FILE>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       soundalike -db <DB> -tracklist [flag]... <FILE>...")
 		fmt.Fprintln(flag.CommandLine.Output(), "Find duplicate audio files within a directory.")
 		fmt.Fprintln(flag.CommandLine.Output())
 		flag.PrintDefaults()
 	}
+	addSegments := flag.Bool("add-segments", false,
+		`Save files in positional args to -db as known segments (e.g. intros) to ignore when comparing`)
+	flag.BoolVar(&opts.cacheLookup, "cache-lookup", opts.cacheLookup,
+		`Save lookup table in database given via -db to speed up later scans`)
+	flag.StringVar(&opts.cluster, "cluster", opts.cluster,
+		`Grouping method: "components" (matches chain), "complete" (all pairs match), or "clique"`)
 	compare := flag.Bool("compare", false, `Compare two files given via positional args instead of scanning directory`+
 		"\n(increases -fpcalc-length by default)")
-	compareInterval := flag.Int("compare-interval", 0, `Score interval for -compare (0 to print overall score)`)
+	compareInterval := flag.Int("compare-interval", 0, `Score interval for -compare (0 to print overall scores)`)
 	dbPath := flag.String("db", "", `SQLite database file for storing file info (temp file if unset)`)
+	dirMinCoverage := flag.Float64("dir-min-coverage", 0.5,
+		`Min fraction in [0.0, 1.0] of duplicate files in directory pairs reported by -dir-report`)
+	dirReport := flag.Bool("dir-report", false, `Report pairs of directories (e.g. albums) containing duplicate files`+
+		"\ninstead of groups of files")
+	flag.Float64Var(&opts.durationDiff, "duration-diff", opts.durationDiff,
+		`Max difference in seconds between durations of compared files (0 to disable)`)
+	flag.Float64Var(&opts.durationRatio, "duration-ratio", opts.durationRatio,
+		`Min ratio of shorter to longer duration of compared files (0 to disable)`)
+	flag.StringVar(&opts.ensembleCombine, "ensemble-combine", opts.ensembleCombine,
+		`Method for combining -fpcalc-ensemble scores: "min" or "mean"`)
 	exclude := flag.Bool("exclude", false, `Update database to exclude files in positional args from being grouped together`)
+	excludeTier := flag.String("exclude-tier", "", `Tier from -tiers at which -exclude applies (stricter tiers can still match)`)
 	flag.StringVar(&opts.fileString, "file-regexp", opts.fileString, "Regular expression for audio files")
+	filesFrom := flag.String("files-from", "", `File listing paths to scan within DIR instead of all files ("-" for stdin)`+
+		"\n(newline- or NUL-separated, absolute or relative to DIR)")
+	flag.BoolVar(&opts.findContained, "find-contained", opts.findContained,
+		"Also report files contained within longer files\n(requires -fpcalc-length to be set to the longest file's duration)")
+	flag.BoolVar(&opts.followSymlinks, "follow-symlinks", opts.followSymlinks,
+		"Follow symlinks to directories within DIR\n(files reachable via multiple symlinks are only scanned once)")
 	flag.IntVar(&fps.algorithm, "fpcalc-algorithm", fps.algorithm, `Fingerprint algorithm`)
 	flag.Float64Var(&fps.chunk, "fpcalc-chunk", fps.chunk, `Audio chunk duration in seconds`)
+	ensemble := flag.String("fpcalc-ensemble", "",
+		`Comma-separated additional fingerprint algorithms used to score matches`+
+			"\n(segments from -add-segments aren't masked in these fingerprints)")
 	flag.Float64Var(&fps.length, "fpcalc-length", fps.length, `Max audio duration in seconds to process`)
 	flag.BoolVar(&fps.overlap, "fpcalc-overlap", fps.overlap, `Overlap audio chunks in fingerprints`)
+	flag.IntVar(&opts.frameMaxBits, "frame-max-bits", opts.frameMaxBits,
+		`Max differing bits for similar values with -match-scorer=frames`)
+	flag.BoolVar(&opts.logDuration, "log-duration", opts.logDuration,
+		`Log matches skipped due to -duration-diff or -duration-ratio`)
 	flag.IntVar(&opts.logSec, "log-sec", opts.logSec, `Logging frequency in seconds (0 or negative to disable logging)`)
+	flag.BoolVar(&opts.logVerify, "log-verify", opts.logVerify,
+		`Log matches skipped due to -verify-length`)
 	flag.Float64Var(&opts.lookupThresh, "lookup-threshold", opts.lookupThresh, `Threshold for lookup table in (0.0, 1.0]`)
+	flag.BoolVar(&opts.loopShortFiles, "loop-short-files", opts.loopShortFiles,
+		`Loop files too short to fingerprint using ffmpeg (matches are lower-confidence)`)
+	flag.IntVar(&opts.lshBits, "lsh-bits", opts.lshBits, `Fingerprint bits used by each LSH table in [1, 16]`)
+	flag.IntVar(&opts.lshTables, "lsh-tables", opts.lshTables,
+		`Number of LSH tables to use to find candidates (0 to use top bits of fingerprint values)`)
 	flag.Float64Var(&opts.matchThresh, "match-threshold", opts.matchThresh, `Threshold for bitwise comparisons in (0.0, 1.0]`)
 	flag.BoolVar(&opts.matchMinLength, "match-min-length", opts.matchMinLength,
 		`Use shorter fingerprint length when scoring bitwise comparisons`)
+	flag.StringVar(&opts.scorer, "match-scorer", opts.scorer,
+		`Comparison score: "bits" (ratio of identical bits) or "frames" (ratio of similar values)`)
+	flag.Float64Var(&opts.maxOffset, "max-offset", opts.maxOffset,
+		`Max seconds to shift fingerprints when comparing them (0 for unlimited)`)
 	printFileInfo := flag.Bool("print-file-info", true, `Print file sizes and durations`)
 	printFullPaths := flag.Bool("print-full-paths", false, `Print absolute file paths (rather than relative to dir)`)
 	flag.BoolVar(&opts.skipBadFiles, "skip-bad-files", opts.skipBadFiles, `Skip files that can't be fingerprinted by fpcalc`)
 	flag.BoolVar(&opts.skipNewFiles, "skip-new-files", opts.skipNewFiles, `Skip files not already in database given via -db`)
+	query := flag.Bool("query", false, `Find files in -db matching files in positional args instead of scanning directory`)
+	refDBPath := flag.String("ref-db", "", `SQLite database file with reference files to check dir against`)
+	refDir := flag.String("ref-dir", "", `Directory with reference files to check dir against (saved to -ref-db if set)`)
+	flag.Var((*stringList)(&opts.skip), "skip", `Gitignore-style pattern of paths within DIR to skip (can be repeated)`+
+		"\n(patterns can also be listed in "+ignoreFile+" files)")
+	flag.StringVar(&opts.tierString, "tiers", opts.tierString,
+		`Comma-separated "name=threshold" match tiers, e.g. "dup=0.95,remaster=0.8"`+
+			"\n(can't be used with -match-threshold)")
+	tracklist := flag.Bool("tracklist", false,
+		`Find files in -db within long files (e.g. DJ mixes) in positional args instead of scanning directory`)
+	flag.Float64Var(&opts.verifyLength, "verify-length", opts.verifyLength,
+		`Max audio duration in seconds to fingerprint to verify matches (0 to disable)`+
+			"\n(ignored if not greater than -fpcalc-length)")
 	printVersion := flag.Bool("version", false, `Print version and exit`)
 	flag.Parse()
 
@@ -55,6 +113,12 @@ func main() {
 			return 0
 		}
 
+		var err error
+		if fps.ensemble, err = parseAlgorithms(*ensemble); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad -fpcalc-ensemble:", err)
+			return 2
+		}
+
 		// Perform some initial checks before creating the database file.
 		if *compare {
 			if flag.NArg() != 2 {
@@ -70,17 +134,76 @@ func main() {
 				fmt.Fprintln(os.Stderr, "-exclude requires -db")
 				return 2
 			}
+		} else if *addSegments {
+			if flag.NArg() < 1 {
+				flag.Usage()
+				return 2
+			}
+			if *dbPath == "" {
+				fmt.Fprintln(os.Stderr, "-add-segments requires -db")
+				return 2
+			}
+		} else if *excludeTier != "" {
+			fmt.Fprintln(os.Stderr, "-exclude-tier requires -exclude")
+			return 2
+		} else if *query || *tracklist {
+			if flag.NArg() < 1 {
+				flag.Usage()
+				return 2
+			}
+			if *dbPath == "" {
+				fmt.Fprintln(os.Stderr, "-query and -tracklist require -db")
+				return 2
+			}
 		} else {
 			if flag.NArg() != 1 {
 				flag.Usage()
 				return 2
 			}
+			if *refDBPath != "" || *refDir != "" {
+				if *refDBPath != "" && *refDBPath == *dbPath {
+					fmt.Fprintln(os.Stderr, "-ref-db and -db must be different")
+					return 2
+				}
+				if opts.cacheLookup && *refDBPath == "" {
+					fmt.Fprintln(os.Stderr, "-cache-lookup requires -ref-db with -ref-dir")
+					return 2
+				}
+			} else if opts.cacheLookup && *dbPath == "" {
+				fmt.Fprintln(os.Stderr, "-cache-lookup requires -db")
+				return 2
+			}
 			opts.dir = flag.Arg(0)
+			if *filesFrom != "" {
+				if opts.files, err = readFileListPath(*filesFrom); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed reading -files-from:", err)
+					return 1
+				}
+			}
+		}
+		if opts.tierString != "" && flagWasSet("match-threshold") {
+			fmt.Fprintln(os.Stderr, "-match-threshold can't be used with -tiers")
+			return 2
 		}
 		if err := opts.finish(); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			return 2
 		}
+		if *excludeTier != "" && opts.tierIndexByName(*excludeTier) < 0 {
+			fmt.Fprintf(os.Stderr, "-exclude-tier %q not in -tiers\n", *excludeTier)
+			return 2
+		}
+		if opts.findContained && !flagWasSet("fpcalc-length") {
+			// Files at least as long as the default length all get the same fingerprint
+			// length, so none of them can be contained within another. The length can't
+			// be raised automatically since it needs to match the database's settings.
+			fmt.Fprintf(os.Stderr, "-find-contained requires -fpcalc-length (default %v is too short)\n", fps.length)
+			return 2
+		}
+		if *dirMinCoverage < 0 || *dirMinCoverage > 1 {
+			fmt.Fprintf(os.Stderr, "-dir-min-coverage %v not in [0.0, 1.0]\n", *dirMinCoverage)
+			return 2
+		}
 
 		if !haveFpcalc() {
 			advice := "install from https://github.com/acoustid/chromaprint/releases"
@@ -91,6 +214,11 @@ func main() {
 			return 1
 		}
 
+		if opts.loopShortFiles && !haveFfmpeg() {
+			fmt.Fprintln(os.Stderr, "-loop-short-files requires ffmpeg and ffprobe")
+			return 1
+		}
+
 		if *compare {
 			// If -fpcalc-length wasn't specified, make it default to a larger
 			// value so we'll fingerprint the files in their entirety.
@@ -100,32 +228,18 @@ func main() {
 			return doCompare(flag.Arg(0), flag.Arg(1), opts, fps, *compareInterval)
 		}
 
-		if *dbPath == "" {
-			f, err := ioutil.TempFile("", "soundalike.db.*")
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed creating temp file for database:", err)
-				return 1
-			}
-			f.Close()
-			*dbPath = f.Name()
-			defer os.Remove(*dbPath)
-		}
-		db, err := newAudioDB(*dbPath, fps)
+		db, closeDB, err := openDB(*dbPath, fps)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed opening database:", err)
+			fmt.Fprintln(os.Stderr, err)
 			return 1
 		}
-		defer func() {
-			if err := db.close(); err != nil {
-				fmt.Fprintln(os.Stderr, "Failed closing database:", err)
-			}
-		}()
+		defer closeDB()
 
 		if *exclude {
 			// Save all possible pairs within the group.
 			for i := 0; i < flag.NArg()-1; i++ {
 				for j := i + 1; j < flag.NArg(); j++ {
-					if err := db.saveExcludedPair(flag.Arg(i), flag.Arg(j)); err != nil {
+					if err := db.saveExcludedPair(flag.Arg(i), flag.Arg(j), *excludeTier); err != nil {
 						fmt.Fprintln(os.Stderr, "Failed saving excluded pair:", err)
 						return 1
 					}
@@ -134,35 +248,111 @@ func main() {
 			return 0
 		}
 
-		groups, err := scanFiles(opts, db, fps)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed scanning files:", err)
-			return 1
+		if *addSegments {
+			return doAddSegments(flag.Args(), db, fps)
+		}
+		if *tracklist {
+			return doTracklist(flag.Args(), opts, db, fps)
+		}
+		if *query {
+			return doQuery(flag.Args(), opts, db, fps, *printFileInfo)
 		}
 
 		var pre string
 		if *printFullPaths {
 			pre = opts.dir + "/"
 		}
-		for i, infos := range groups {
+
+		if *refDBPath != "" || *refDir != "" {
+			refDB, closeRefDB, err := openDB(*refDBPath, fps)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer closeRefDB()
+			ref, err := loadReference(opts, refDB, *refDir, fps)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed loading reference files:", err)
+				return 1
+			}
+			results, err := scanReference(opts, db, ref, fps)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed scanning files:", err)
+				return 1
+			}
+			var refPre string
+			if *printFullPaths && *refDir != "" {
+				refPre = *refDir + "/"
+			}
+			for i, res := range results {
+				if i != 0 {
+					fmt.Println()
+				}
+				for _, ln := range formatQueryResult(res, pre, refPre, *printFileInfo) {
+					fmt.Println(ln)
+				}
+			}
+			return 0
+		}
+
+		res, err := scanFiles(opts, db, fps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed scanning files:", err)
+			return 1
+		}
+
+		if *dirReport {
+			for i, m := range findDirMatches(res, *dirMinCoverage) {
+				if i != 0 {
+					fmt.Println()
+				}
+				for _, ln := range formatDirMatch(m, pre) {
+					fmt.Println(ln)
+				}
+			}
+			return 0
+		}
+
+		for i, g := range res.groups {
 			if i != 0 {
 				fmt.Println()
 			}
+			if g.tier != "" {
+				fmt.Printf("[%v]\n", g.tier)
+			}
 			if *printFileInfo {
-				for _, ln := range formatFiles(infos, pre) {
+				for _, ln := range formatFiles(g.files, pre) {
 					fmt.Println(ln)
 				}
 			} else {
-				for _, info := range infos {
+				for _, info := range g.files {
 					fmt.Println(pre + info.path)
 				}
 			}
+			if len(opts.tiers) > 0 {
+				for _, m := range g.matches {
+					fmt.Println(formatMatch(m, pre))
+				}
+			}
+		}
+		if len(res.contained) > 0 {
+			if len(res.groups) > 0 {
+				fmt.Println()
+			}
+			for _, c := range res.contained {
+				fmt.Println(formatContainment(c, pre))
+			}
 		}
-
 		return 0
 	}())
 }
 
+// stringList implements flag.Value for flags that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
 // flagWasSet returns true if the specified flag was passed on the command line.
 func flagWasSet(name string) bool {
 	var found bool
@@ -174,6 +364,36 @@ func flagWasSet(name string) bool {
 	return found
 }
 
+// openDB opens the audioDB at path, using a temp file if path is empty.
+// The returned function closes the database and removes the temp file.
+func openDB(path string, fps *fpcalcSettings) (*audioDB, func(), error) {
+	var temp bool
+	if path == "" {
+		f, err := ioutil.TempFile("", "soundalike.db.*")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed creating temp file for database: %v", err)
+		}
+		f.Close()
+		path = f.Name()
+		temp = true
+	}
+	db, err := newAudioDB(path, fps)
+	if err != nil {
+		if temp {
+			os.Remove(path)
+		}
+		return nil, nil, fmt.Errorf("failed opening database: %v", err)
+	}
+	return db, func() {
+		if err := db.close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed closing database:", err)
+		}
+		if temp {
+			os.Remove(path)
+		}
+	}, nil
+}
+
 // doVersion prints the soundalike and fpcalc versions to stdout.
 func doVersion() {
 	fmt.Printf("soundalike version %v compiled with %v for %v/%v\n",
@@ -197,9 +417,11 @@ func doCompare(pa, pb string, opts *scanOptions, fps *fpcalcSettings, interval i
 		fmt.Fprintf(os.Stderr, "Failed fingerprinting %v: %v\n", pb, err)
 		return 1
 	}
-	score, aoff, boff := compareFingerprints(ra.Fingerprint, rb.Fingerprint, opts.matchMinLength)
+	lo, hi := opts.offsetRange()
+	score, aoff, boff := compareFingerprintsRange(ra.Fingerprint, rb.Fingerprint, opts.matchMinLength, lo, hi)
 	if interval <= 0 {
-		fmt.Printf("%0.3f\n", score)
+		fscore := frameScore(ra.Fingerprint, rb.Fingerprint, nil, nil, aoff, boff, opts.matchMinLength, opts.frameMaxBits)
+		fmt.Printf("bits=%0.3f frames=%0.3f\n", score, fscore)
 	} else {
 		if aoff > boff {
 			fmt.Printf("[%d only in b]\n", aoff-boff)
@@ -208,18 +430,27 @@ func doCompare(pa, pb string, opts *scanOptions, fps *fpcalcSettings, interval i
 		}
 		a := ra.Fingerprint[aoff:]
 		b := rb.Fingerprint[boff:]
-		var i, ncmp, nbits int
+		var i, ncmp, nbits, nframes int
+		printInterval := func() {
+			fmt.Printf("%4d: bits=%0.3f frames=%0.3f\n", i,
+				float64(nbits)/float64(32*ncmp), float64(nframes)/float64(ncmp))
+		}
 		for ; i < len(a) && i < len(b); i++ {
 			if i%interval == 0 && ncmp > 0 {
-				fmt.Printf("%4d: %0.3f\n", i, float64(nbits)/float64(32*ncmp))
+				printInterval()
 				nbits = 0
+				nframes = 0
 				ncmp = 0
 			}
-			nbits += 32 - bits.OnesCount32(a[i]^b[i])
+			diff := bits.OnesCount32(a[i] ^ b[i])
+			nbits += 32 - diff
+			if diff <= opts.frameMaxBits {
+				nframes++
+			}
 			ncmp++
 		}
 		if ncmp > 0 {
-			fmt.Printf("%4d: %0.3f\n", i, float64(nbits)/float64(32*ncmp))
+			printInterval()
 		}
 		if na, nb := len(a), len(b); na > nb {
 			fmt.Printf("[%d only in a]\n", na-nb)
@@ -230,7 +461,109 @@ func doCompare(pa, pb string, opts *scanOptions, fps *fpcalcSettings, interval i
 	return 0
 }
 
+// doAddSegments saves the files at paths as known segments in db on behalf of the
+// -add-segments flag.
+func doAddSegments(paths []string, db *audioDB, fps *fpcalcSettings) int {
+	// Fingerprint the entire segment, but use the same algorithm as the database.
+	settings := fps.withAlgorithm(fps.algorithm)
+	settings.length = 7200
+	for _, p := range paths {
+		res, err := runFpcalc(p, settings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed fingerprinting %v: %v\n", p, err)
+			return 1
+		}
+		if err := db.saveSegment(p, res.Fingerprint); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed saving %v: %v\n", p, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// doQuery prints the files in db that match the files at paths on behalf of the
+// -query flag. The query files aren't added to db.
+func doQuery(paths []string, opts *scanOptions, db *audioDB, fps *fpcalcSettings, printInfo bool) int {
+	ref, err := loadReference(opts, db, "", fps)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed loading files from database:", err)
+		return 1
+	}
+	for i, p := range paths {
+		info, err := fingerprintFile(p, fps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed fingerprinting %v: %v\n", p, err)
+			return 1
+		}
+		info.mask = db.mask(info.fprint)
+		matches, err := ref.query(opts, info)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed querying %v: %v\n", p, err)
+			return 1
+		}
+		if i != 0 {
+			fmt.Println()
+		}
+		for _, ln := range formatQueryResult(&queryResult{info, matches}, "", "", printInfo) {
+			fmt.Println(ln)
+		}
+	}
+	return 0
+}
+
+// doTracklist prints the files in db that appear within the long files at paths on
+// behalf of the -tracklist flag.
+func doTracklist(paths []string, opts *scanOptions, db *audioDB, fps *fpcalcSettings) int {
+	ref, err := loadReference(opts, db, "", fps)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed loading files from database:", err)
+		return 1
+	}
+	// Fingerprint the entire file, but use the same algorithm as the database.
+	settings := fps.withAlgorithm(fps.algorithm)
+	settings.length = maxMixLength
+	for i, p := range paths {
+		res, err := runFpcalc(p, settings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed fingerprinting %v: %v\n", p, err)
+			return 1
+		}
+		if res.Duration > maxMixLength {
+			fmt.Fprintf(os.Stderr, "Warning: only checking first %v of %v (%v)\n",
+				formatSeconds(maxMixLength), p, formatSeconds(res.Duration))
+		}
+		tracks, err := findTracks(opts, ref, res.Fingerprint, fps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed finding tracks in %v: %v\n", p, err)
+			return 1
+		}
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Println(p)
+		for _, t := range tracks {
+			fmt.Printf("  %6s  %v  %0.3f\n", formatSeconds(t.start), t.info.path, t.score)
+		}
+	}
+	return 0
+}
+
+// readFileListPath reads a list of files from the file at p (or stdin if p is "-").
+func readFileListPath(p string) ([]string, error) {
+	if p == "-" {
+		return readFileList(os.Stdin)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readFileList(f)
+}
+
 // formatFiles returns column-aligned lines describing each supplied file.
+// Files fingerprinted by looping short clips are marked since their matches are
+// less reliable.
 func formatFiles(infos []*fileInfo, pathPrefix string) []string {
 	if len(infos) == 0 {
 		return nil
@@ -259,6 +592,81 @@ func formatFiles(infos []*fileInfo, pathPrefix string) []string {
 	}, "  ")
 	for i, row := range rows {
 		lines[i] = fmt.Sprintf(fs, row[0], row[1], row[2])
+		if infos[i].short {
+			lines[i] += "  [short clip]"
+		}
 	}
 	return lines
 }
+
+// formatContainment returns a line describing c.
+func formatContainment(c *containment, pathPrefix string) string {
+	return fmt.Sprintf("%v is contained in %v at %v",
+		pathPrefix+c.short.path, pathPrefix+c.long.path, formatSeconds(c.offset))
+}
+
+// formatDirMatch returns lines describing m. The first line lists the directories
+// and their coverage, and each following line lists a file missing from one of them.
+func formatDirMatch(m *dirMatch, pathPrefix string) []string {
+	lns := []string{fmt.Sprintf("%0.1f%%  %v (%d)  %v (%d)", 100*m.coverage,
+		pathPrefix+m.a, m.aFiles, pathPrefix+m.b, m.bFiles)}
+	for _, p := range m.aMissing {
+		lns = append(lns, fmt.Sprintf("  %v missing from %v", pathPrefix+p, pathPrefix+m.a))
+	}
+	for _, p := range m.bMissing {
+		lns = append(lns, fmt.Sprintf("  %v missing from %v", pathPrefix+p, pathPrefix+m.b))
+	}
+	return lns
+}
+
+// formatMatch returns an indented line describing m.
+func formatMatch(m *match, pathPrefix string) string {
+	ln := fmt.Sprintf("  %v ~ %v  %0.3f", pathPrefix+m.a.path, pathPrefix+m.b.path, m.score)
+	if m.tier != "" {
+		ln += "  " + m.tier
+	}
+	return ln
+}
+
+// formatQueryResult returns lines describing res. The first line describes the query
+// file and each following line describes a matching file, its score, and its offset.
+func formatQueryResult(res *queryResult, queryPrefix, matchPrefix string, printInfo bool) []string {
+	infos := []*fileInfo{res.query}
+	for _, m := range res.matches {
+		infos = append(infos, m.info)
+	}
+	lines := make([]string, len(infos))
+	if printInfo {
+		lines[0] = formatFiles(infos[:1], queryPrefix)[0]
+		copy(lines[1:], formatFiles(infos[1:], matchPrefix))
+	} else {
+		lines[0] = queryPrefix + res.query.path
+		var max int
+		for _, m := range res.matches {
+			if n := len(matchPrefix + m.info.path); n > max {
+				max = n
+			}
+		}
+		for i, m := range res.matches {
+			lines[i+1] = fmt.Sprintf("%-*s", max, matchPrefix+m.info.path)
+		}
+	}
+	for i, m := range res.matches {
+		lines[i+1] = fmt.Sprintf("  %v  %0.3f  %v", lines[i+1], m.score, formatSeconds(m.offset))
+		if m.tier != "" {
+			lines[i+1] += "  " + m.tier
+		}
+	}
+	return lines
+}
+
+// formatSeconds formats sec as "[-]m:ss".
+func formatSeconds(sec float64) string {
+	var sign string
+	if sec < 0 {
+		sign = "-"
+		sec = -sec
+	}
+	s := int(math.Round(sec))
+	return fmt.Sprintf("%s%d:%02d", sign, s/60, s%60)
+}
@@ -5,9 +5,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -25,12 +27,9 @@ func checkTestEnv() error {
 	return nil
 }
 
-func TestMain_Scan(t *testing.T) {
-	if err := checkTestEnv(); err != nil {
-		t.Fatal("Bad test environment: ", err)
-	}
-
-	want := strings.TrimLeft(`
+// testdataGroups contains the expected output when scanning testdata/
+// with -print-file-info=false.
+var testdataGroups = strings.TrimLeft(`
 64/Fanfare for Space.mp3
 orig/Fanfare for Space.mp3
 pad/Fanfare for Space.mp3
@@ -40,6 +39,13 @@ orig/Honey Bee.mp3
 pad/Honey Bee.mp3
 `, "\n")
 
+func TestMain_Scan(t *testing.T) {
+	if err := checkTestEnv(); err != nil {
+		t.Fatal("Bad test environment: ", err)
+	}
+
+	want := testdataGroups
+
 	db := filepath.Join(t.TempDir(), "test.db")
 	scanCmd := exec.Command(
 		"soundalike",
@@ -79,6 +85,29 @@ pad/Honey Bee.mp3
 	}
 }
 
+func TestMain_ScanLSH(t *testing.T) {
+	if err := checkTestEnv(); err != nil {
+		t.Fatal("Bad test environment: ", err)
+	}
+
+	// LSH should find the same groups as the default lookup table.
+	for _, tables := range []int{1, 4, 8} {
+		cmd := exec.Command(
+			"soundalike",
+			"-log-sec=0",
+			"-print-file-info=false",
+			"-fpcalc-length=45",
+			"-lsh-tables="+strconv.Itoa(tables),
+			"testdata",
+		)
+		if got, err := cmd.Output(); err != nil {
+			t.Errorf("%s failed: %v", cmd, err)
+		} else if string(got) != testdataGroups {
+			t.Errorf("%s printed unexpected output:\n got: %q\n want: %q", cmd, string(got), testdataGroups)
+		}
+	}
+}
+
 func TestMain_Compare(t *testing.T) {
 	if err := checkTestEnv(); err != nil {
 		t.Fatal("Bad test environment: ", err)
@@ -117,11 +146,14 @@ func TestMain_Compare(t *testing.T) {
 			t.Errorf("%s failed: %v", cmd, err)
 			continue
 		}
-		got, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
-		if err != nil {
+		var got, frames float64
+		if _, err := fmt.Sscanf(string(out), "bits=%f frames=%f\n", &got, &frames); err != nil {
 			t.Errorf("%s printed bad output %q: %v", cmd, string(out), err)
 			continue
 		}
+		if frames < 0 || frames > 1 {
+			t.Errorf("%s printed frame score %0.3f; want [0.0, 1.0]", cmd, frames)
+		}
 		if tc.res == identical && got != 1.0 {
 			t.Errorf("%s returned %0.3f; want 1.0", cmd, got)
 		} else if tc.res == similar && (got < thresh || got >= 1.0) {
@@ -131,3 +163,78 @@ func TestMain_Compare(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatSeconds(t *testing.T) {
+	for _, tc := range []struct {
+		sec  float64
+		want string
+	}{
+		{0, "0:00"},
+		{5.4, "0:05"},
+		{59.6, "1:00"},
+		{754, "12:34"},
+		{-61, "-1:01"},
+	} {
+		if got := formatSeconds(tc.sec); got != tc.want {
+			t.Errorf("formatSeconds(%v) = %q; want %q", tc.sec, got, tc.want)
+		}
+	}
+}
+
+func TestFormatQueryResult(t *testing.T) {
+	res := &queryResult{
+		query: &fileInfo{path: "query.mp3", size: 3 * 1024 * 1024, duration: 180},
+		matches: []*fileMatch{
+			{info: &fileInfo{path: "a/long.mp3", size: 4 * 1024 * 1024, duration: 240.5}, score: 0.981, offset: 62},
+			{info: &fileInfo{path: "b.mp3", size: 3 * 1024 * 1024, duration: 180}, score: 0.956, offset: -1},
+		},
+	}
+	for _, tc := range []struct {
+		printInfo bool
+		want      []string
+	}{
+		{false, []string{
+			"q/query.mp3",
+			"  r/a/long.mp3  0.981  1:02",
+			"  r/b.mp3       0.956  -0:01",
+		}},
+		{true, []string{
+			"q/query.mp3  3.00 MB  180.00 sec",
+			"  r/a/long.mp3  4.00 MB  240.50 sec  0.981  1:02",
+			"  r/b.mp3       3.00 MB  180.00 sec  0.956  -0:01",
+		}},
+	} {
+		if got := formatQueryResult(res, "q/", "r/", tc.printInfo); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("formatQueryResult(..., %v) = %q; want %q", tc.printInfo, got, tc.want)
+		}
+	}
+}
+
+func TestFormatFiles(t *testing.T) {
+	infos := []*fileInfo{
+		{path: "long/name.mp3", size: 5 * 1024 * 1024, duration: 312.5},
+		{path: "beep.wav", size: 20 * 1024, duration: 0.4, short: true},
+	}
+	want := []string{
+		"long/name.mp3  5.00 MB  312.50 sec",
+		"beep.wav       0.02 MB    0.40 sec  [short clip]",
+	}
+	if got := formatFiles(infos, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("formatFiles(...) = %q; want %q", got, want)
+	}
+}
+
+func TestFormatDirMatch(t *testing.T) {
+	m := &dirMatch{
+		a: "Artist/Album", b: "Artist/Album (2)", aFiles: 3, bFiles: 2,
+		bMissing: []string{"Artist/Album/03.mp3"},
+		coverage: 0.8,
+	}
+	want := []string{
+		"80.0%  d/Artist/Album (3)  d/Artist/Album (2) (2)",
+		"  d/Artist/Album/03.mp3 missing from d/Artist/Album (2)",
+	}
+	if got := formatDirMatch(m, "d/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("formatDirMatch(...) = %q; want %q", got, want)
+	}
+}
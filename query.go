@@ -0,0 +1,152 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// fileMatch describes a file in a reference database that matches a query file.
+type fileMatch struct {
+	info   *fileInfo
+	score  float64
+	offset float64 // seconds into matching file where query file starts (negative if earlier)
+	tier   string  // empty if tiers aren't used
+}
+
+// queryResult contains the files in a reference database that match a query file.
+type queryResult struct {
+	query   *fileInfo
+	matches []*fileMatch // sorted by descending score
+}
+
+// reference contains files that query files are checked against.
+type reference struct {
+	db     *audioDB
+	lookup candidateFinder
+	ids    map[fileID]struct{} // files in lookup that can be matched
+	masks  map[fileID][]bool   // non-nil masks of files in ids
+}
+
+// loadReference returns a reference containing the files in db.
+// If dir is non-empty, only files within it are included (and new files in it are
+// fingerprinted and added to db). Otherwise, all files in db are included.
+func loadReference(opts *scanOptions, db *audioDB, dir string, fps *fpcalcSettings) (*reference, error) {
+	lookup, err := newCandidateFinder(opts, db)
+	if err != nil {
+		return nil, err
+	}
+	ref := &reference{
+		db:     db,
+		lookup: lookup,
+		ids:    make(map[fileID]struct{}),
+		masks:  make(map[fileID][]bool),
+	}
+	add := func(info *fileInfo) error {
+		if !lookup.has(info.id) {
+			lookup.add(info.id, info.fprint, info.mask)
+		}
+		ref.ids[info.id] = struct{}{}
+		if info.mask != nil {
+			ref.masks[info.id] = info.mask
+		}
+		return nil
+	}
+	if dir != "" {
+		// Don't apply -skip-new-files or -files-from to the reference directory.
+		ropts := *opts
+		ropts.skipNewFiles = false
+		ropts.files = nil
+		err = walkFiles(dir, &ropts, db, fps, func(info *fileInfo, _ fileID) error { return add(info) })
+	} else {
+		// walkFiles sets masks, but db.forEach doesn't.
+		err = db.forEach(func(info *fileInfo) error {
+			info.mask = db.mask(info.fprint)
+			return add(info)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.cacheLookup {
+		if err := db.saveLookupTable(lookup.(*lookupTable)); err != nil {
+			return nil, fmt.Errorf("saving lookup table: %v", err)
+		}
+	}
+	return ref, nil
+}
+
+// query returns the files in ref that match info.
+func (ref *reference) query(opts *scanOptions, info *fileInfo) ([]*fileMatch, error) {
+	var matches []*fileMatch
+	for _, cand := range ref.lookup.find(info.fprint, info.mask, opts.lookupThreshFor(info)) {
+		if _, ok := ref.ids[cand.id]; !ok {
+			continue
+		}
+		oinfo, err := ref.db.get(cand.id, "")
+		if err != nil {
+			return nil, err
+		} else if oinfo == nil {
+			return nil, fmt.Errorf("%d not in reference database", cand.id)
+		}
+		oinfo.mask = ref.masks[cand.id]
+		if score, shift, ok := opts.compareCandidate(info, oinfo, cand); ok && score >= opts.matchThresh {
+			matches = append(matches, &fileMatch{
+				info:   oinfo,
+				score:  score,
+				offset: float64(shift) / fingerprintRate,
+				tier:   opts.tierName(score),
+			})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].info.path < matches[j].info.path
+	})
+	return matches, nil
+}
+
+// scanReference scans opts.dir and returns files that match files in ref.
+// Matches between files in opts.dir are not reported.
+func scanReference(opts *scanOptions, db *audioDB, ref *reference, fps *fpcalcSettings) ([]*queryResult, error) {
+	var results []*queryResult
+	if err := walkFiles(opts.dir, opts, db, fps, func(info *fileInfo, _ fileID) error {
+		matches, err := ref.query(opts, info)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			results = append(results, &queryResult{info, matches})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].query.path < results[j].query.path })
+	return results, nil
+}
+
+// fingerprintFile returns information about the audio file at p without saving it
+// to a database. The returned fileInfo's id is 0 and its path is p.
+func fingerprintFile(p string, fps *fpcalcSettings) (*fileInfo, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	res, err := runFpcalc(p, fps)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{
+		path:     p,
+		size:     fi.Size(),
+		duration: res.Duration,
+		fprint:   res.Fingerprint,
+	}, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestReference_Query(t *testing.T) {
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "ref.db"), defaultFpcalcSettings())
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	r := rand.New(rand.NewSource(1))
+	orig := randFingerprint(r, 500)
+	infos := []*fileInfo{
+		{path: "a.mp3", duration: 50, fprint: noisyFingerprint(r, orig, 20, 6)}, // starts 20 values later
+		{path: "b.mp3", duration: 50, fprint: randFingerprint(r, 500)},
+		{path: "c.mp3", duration: 50, fprint: orig},
+	}
+	for _, info := range infos {
+		if info.id, err = db.save(info); err != nil {
+			t.Fatal("save failed: ", err)
+		}
+	}
+
+	opts := defaultScanOptions()
+	opts.tierString = "dup=0.99,similar=0.9"
+	if err := opts.finish(); err != nil {
+		t.Fatal("finish failed: ", err)
+	}
+	ref, err := loadReference(opts, db, "", defaultFpcalcSettings())
+	if err != nil {
+		t.Fatal("loadReference failed: ", err)
+	}
+	query := &fileInfo{path: "query.mp3", duration: 50, fprint: orig}
+	matches, err := ref.query(opts, query)
+	if err != nil {
+		t.Fatal("query failed: ", err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.info.path)
+	}
+	if len(matches) != 2 || matches[0].info.path != "c.mp3" || matches[1].info.path != "a.mp3" {
+		t.Fatalf("query returned %q; want [c.mp3 a.mp3]", got)
+	}
+	if matches[0].score != 1 || matches[0].offset != 0 {
+		t.Errorf("c.mp3 matched with score %0.3f at %0.3f; want 1.000 at 0.000", matches[0].score, matches[0].offset)
+	}
+	if want := 20 / fingerprintRate; matches[1].offset != want {
+		t.Errorf("a.mp3 matched at %0.3f; want %0.3f", matches[1].offset, want)
+	}
+	if matches[0].tier != "dup" || matches[1].tier != "similar" {
+		t.Errorf("Matches have tiers %q and %q; want %q and %q", matches[0].tier, matches[1].tier, "dup", "similar")
+	}
+}
@@ -4,28 +4,108 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"math/bits"
+	"math"
 	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
+)
+
+// offsetSlop is the number of positions on either side of a candidate's offset
+// from the lookup table that are checked when comparing fingerprints.
+const offsetSlop = 2
+
+// Values for scanOptions.ensembleCombine.
+const (
+	minCombine  = "min"  // minimum score across algorithms
+	meanCombine = "mean" // mean score across algorithms
+)
+
+// Values for scanOptions.scorer.
+const (
+	bitsScorer   = "bits"   // ratio of identical bits
+	framesScorer = "frames" // ratio of values with few differing bits (see frameScore)
 )
 
 // scanOptions contains options for scanFiles.
 type scanOptions struct {
-	dir            string         // directory containing audio files
-	fileString     string         // uncompiled fileRegexp
-	fileRegexp     *regexp.Regexp // matches files to scan
-	logSec         int            // logging frequency
-	lookupThresh   float64        // threshold for lookup table in (0.0, 1.0]
-	matchThresh    float64        // threshold for bitwise comparisons in (0.0, 1.0]
-	matchMinLength bool           // use min length (instead of max) for bitwise comparisons
-	skipBadFiles   bool           // skip files that can't be fingerprinted by fpcalc
-	skipNewFiles   bool           // skip files that aren't in database
+	dir             string         // directory containing audio files
+	cacheLookup     bool           // save lookup table in database between scans
+	cluster         string         // method used to group files (e.g. componentsCluster)
+	durationDiff    float64        // max difference in seconds between compared files' durations (0 to disable)
+	durationRatio   float64        // min ratio of shorter to longer duration for compared files (0 to disable)
+	ensembleCombine string         // method used to combine scores from multiple algorithms (e.g. minCombine)
+	files           []string       // paths (absolute or relative to dir) to scan instead of all of dir
+	fileString      string         // uncompiled fileRegexp
+	fileRegexp      *regexp.Regexp // matches files to scan
+	findContained   bool           // find files contained within longer files
+	followSymlinks  bool           // follow symlinks to directories and skip files reached via multiple links
+	logDuration     bool           // log matches that were skipped due to durations
+	logSec          int            // logging frequency
+	logVerify       bool           // log matches that were skipped due to full-length scores
+	lookupThresh    float64        // threshold for lookup table in (0.0, 1.0]
+	lshTables       int            // LSH tables to use instead of lookupTable (0 to disable)
+	lshBits         int            // bits per LSH table key in [1, 16]
+	loopShortFiles  bool           // loop files that are too short to fingerprint
+	matchThresh     float64        // threshold for bitwise comparisons in (0.0, 1.0]
+	maxOffset       float64        // max seconds to shift fingerprints when comparing (0 for unlimited)
+	matchMinLength  bool           // use min length (instead of max) for bitwise comparisons
+	scorer          string         // method used to score comparisons ("bits" or "frames")
+	frameMaxBits    int            // max differing bits for a matching value with "frames" scorer
+	skip            []string       // gitignore-style patterns of paths to skip (see ignoreFile)
+	skipRules       []ignoreRule   // compiled skip
+	skipBadFiles    bool           // skip files that can't be fingerprinted by fpcalc
+	skipNewFiles    bool           // skip files that aren't in database
+	tierString      string         // unparsed tiers, e.g. "dup=0.95,remaster=0.8"
+	tiers           []tier         // named thresholds sorted by descending threshold
+	verifyLength    float64        // seconds of audio to fingerprint when verifying matches (0 to disable)
+}
+
+// tier is a named similarity threshold. When tiers are used, matches are labeled
+// with the strictest tier whose threshold they reach.
+type tier struct {
+	name   string
+	thresh float64
+}
+
+// parseTiers parses a comma-separated list of "name=threshold" tiers.
+// The returned tiers are sorted by descending threshold.
+func parseTiers(s string) ([]tier, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tiers []tier
+	names := make(map[string]struct{})
+	for _, str := range strings.Split(s, ",") {
+		parts := strings.SplitN(str, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q isn't name=threshold", str)
+		}
+		name := parts[0]
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicate tier %q", name)
+		}
+		if name == identicalTier {
+			return nil, fmt.Errorf("tier name %q is reserved", name)
+		}
+		names[name] = struct{}{}
+		thresh, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || thresh <= 0 || thresh > 1.0 {
+			return nil, fmt.Errorf("bad threshold %q for %q", parts[1], name)
+		}
+		tiers = append(tiers, tier{name, thresh})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].thresh > tiers[j].thresh })
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].thresh == tiers[i-1].thresh {
+			return nil, fmt.Errorf("%q and %q have the same threshold", tiers[i-1].name, tiers[i].name)
+		}
+	}
+	return tiers, nil
 }
 
 func defaultScanOptions() *scanOptions {
@@ -33,11 +113,16 @@ func defaultScanOptions() *scanOptions {
 		// TODO: I'm just guessing what should be included here. See
 		// https://en.wikipedia.org/wiki/Audio_file_format#List_of_formats and
 		// https://en.wikipedia.org/wiki/FFmpeg#Supported_codecs_and_formats.
-		fileString:   `(?i)\.(aiff|flac|m4a|mp3|oga|ogg|opus|wav|wma)$`,
-		logSec:       10,
-		lookupThresh: 0.25,
-		matchThresh:  0.95,
-		skipBadFiles: true,
+		cluster:         componentsCluster,
+		ensembleCombine: minCombine,
+		fileString:      `(?i)\.(aiff|flac|m4a|mp3|oga|ogg|opus|wav|wma)$`,
+		logSec:          10,
+		lookupThresh:    0.25,
+		lshBits:         16,
+		matchThresh:     0.95,
+		scorer:          bitsScorer,
+		frameMaxBits:    6,
+		skipBadFiles:    true,
 	}
 }
 
@@ -51,200 +136,653 @@ func (o *scanOptions) finish() error {
 		}
 	}
 
+	if o.durationDiff < 0 {
+		return fmt.Errorf("bad duration difference %v", o.durationDiff)
+	}
+	if o.durationRatio < 0 || o.durationRatio > 1.0 {
+		return fmt.Errorf("bad duration ratio %v", o.durationRatio)
+	}
 	if o.lookupThresh <= 0 || o.lookupThresh > 1.0 {
 		return fmt.Errorf("bad lookup threshold %v", o.lookupThresh)
 	}
+	var err error
+	if o.tiers, err = parseTiers(o.tierString); err != nil {
+		return fmt.Errorf("bad tiers: %v", err)
+	} else if len(o.tiers) > 0 {
+		o.matchThresh = o.tiers[len(o.tiers)-1].thresh
+	}
 	if o.matchThresh <= 0 || o.matchThresh > 1.0 {
 		return fmt.Errorf("bad match threshold %v", o.matchThresh)
 	}
+	switch o.cluster {
+	case componentsCluster, completeCluster, cliqueCluster:
+	default:
+		return fmt.Errorf("bad clustering method %q", o.cluster)
+	}
+	if o.ensembleCombine != minCombine && o.ensembleCombine != meanCombine {
+		return fmt.Errorf("bad ensemble combination method %q", o.ensembleCombine)
+	}
+	if o.scorer != bitsScorer && o.scorer != framesScorer {
+		return fmt.Errorf("bad scorer %q", o.scorer)
+	}
+	if o.frameMaxBits < 0 || o.frameMaxBits > 32 {
+		return fmt.Errorf("bad frame max bits %v", o.frameMaxBits)
+	}
+	if o.verifyLength < 0 {
+		return fmt.Errorf("bad verify length %v", o.verifyLength)
+	}
+	if o.maxOffset < 0 {
+		return fmt.Errorf("bad max offset %v", o.maxOffset)
+	}
+	if o.lshTables < 0 {
+		return fmt.Errorf("bad LSH table count %v", o.lshTables)
+	}
+	if o.lshBits < 1 || o.lshBits > 16 {
+		return fmt.Errorf("bad LSH bit count %v", o.lshBits)
+	}
+	if o.lshTables > 0 && o.cacheLookup {
+		return errors.New("lookup table can't be cached when using LSH")
+	}
 
-	var err error
 	if o.fileRegexp, err = regexp.Compile(o.fileString); err != nil {
 		return fmt.Errorf("bad file regexp: %v", err)
 	}
+	o.skipRules = nil
+	for _, pat := range o.skip {
+		if rule, ok, err := parseIgnoreRule(pat); err != nil {
+			return fmt.Errorf("bad skip pattern %q: %v", pat, err)
+		} else if ok {
+			o.skipRules = append(o.skipRules, rule)
+		}
+	}
 
 	return nil
 }
 
-// scanFiles scans opts.dir and returns groups of similar files.
-func scanFiles(opts *scanOptions, db *audioDB, fps *fpcalcSettings) ([][]*fileInfo, error) {
-	// filepath.Walk doesn't follow symlinks, so do it manually first.
-	dir, err := filepath.EvalSymlinks(opts.dir)
-	if err != nil {
-		return nil, err
+// offsetRange returns the range of shifts (in fingerprint values) that should be
+// checked when comparing fingerprints. See compareFingerprintsRange.
+func (o *scanOptions) offsetRange() (lo, hi int) {
+	if o.maxOffset <= 0 {
+		return math.MinInt32, math.MaxInt32
 	}
+	n := secondsToValues(o.maxOffset)
+	return -n, n
+}
 
-	lookup := newLookupTable()
-	edges := make(map[fileID][]fileID)
+// offsetRangeNear is like offsetRange but additionally limits the range to
+// shifts within offsetSlop of the supplied offset from the lookup table.
+func (o *scanOptions) offsetRangeNear(offset int) (lo, hi int) {
+	lo, hi = o.offsetRange()
+	if l := offset - offsetSlop; l > lo {
+		lo = l
+	}
+	if h := offset + offsetSlop; h < hi {
+		hi = h
+	}
+	return lo, hi
+}
 
-	lastLog := time.Now()
-	var scanned int
-	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
-		if p == dir || fi.IsDir() || !opts.fileRegexp.MatchString(filepath.Base(p)) {
-			return nil
+// durationsCompatible returns false if files with durations a and b (in seconds)
+// shouldn't be compared per durationDiff and durationRatio. If both are set, the
+// files are compatible if either condition is satisfied.
+func (o *scanOptions) durationsCompatible(a, b float64) bool {
+	if o.durationDiff <= 0 && o.durationRatio <= 0 {
+		return true
+	}
+	if o.durationDiff > 0 && math.Abs(a-b) <= o.durationDiff {
+		return true
+	}
+	if o.durationRatio > 0 {
+		if a > b {
+			a, b = b, a
+		}
+		if b <= 0 || a/b >= o.durationRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupThreshFor returns the minimum number of keys that a file must share with
+// info's unmasked values to be returned by candidateFinder.find.
+func (o *scanOptions) lookupThreshFor(info *fileInfo) int {
+	n := len(info.fprint)
+	for _, m := range info.mask {
+		if m {
+			n--
 		}
+	}
+	return int(float64(n) * o.lookupThresh)
+}
 
-		rel, err := filepath.Rel(dir, p)
-		if err != nil {
-			return err
+// tierIndex returns the index into tiers of the strictest tier reached by score,
+// or -1 if score doesn't reach any tier.
+func (o *scanOptions) tierIndex(score float64) int {
+	for i, t := range o.tiers {
+		if score >= t.thresh {
+			return i
 		}
+	}
+	return -1
+}
 
-		info, err := db.get(0, rel)
-		if err != nil {
-			return fmt.Errorf("get %q: %v", rel, err)
-		} else if info == nil {
-			if opts.skipNewFiles {
-				return nil
-			}
-			finfo, err := runFpcalc(p, fps)
-			if err == errEmptyFingerprint {
-				return nil // skip short files
-			} else if err != nil {
-				if opts.skipBadFiles {
-					log.Printf("Skipping %v: %v", p, err)
-					return nil
-				}
-				return fmt.Errorf("%v: %v", p, err)
-			}
-			info = &fileInfo{
-				path:     rel,
-				size:     fi.Size(),
-				duration: finfo.Duration,
-				fprint:   finfo.Fingerprint,
+// tierName returns the name of the strictest tier reached by score.
+// An empty string is returned if tiers aren't being used.
+func (o *scanOptions) tierName(score float64) string {
+	if i := o.tierIndex(score); i >= 0 {
+		return o.tiers[i].name
+	}
+	return ""
+}
+
+// tierIndexByName returns the index into tiers of the named tier, or -1 if it isn't present.
+func (o *scanOptions) tierIndexByName(name string) int {
+	for i, t := range o.tiers {
+		if t.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// excludedAt returns true if a pair of files that was excluded at the named tier
+// (see audioDB.saveExcludedPair) shouldn't be matched with the supplied score.
+// Such pairs can only be matched at stricter tiers. An empty or unknown tier
+// excludes all matches.
+func (o *scanOptions) excludedAt(name string, score float64) bool {
+	i := o.tierIndexByName(name)
+	if i < 0 {
+		return true
+	}
+	ti := o.tierIndex(score)
+	return ti < 0 || ti >= i
+}
+
+// compare compares a and b using the configured scorer, only checking alignments
+// where b is shifted by [lo, hi] positions relative to a (see compareFingerprintsRange).
+// The alignment is always chosen using the bitwise ratio. Positions where am or bm
+// (which may be nil) are true are ignored.
+func (o *scanOptions) compare(a, b []uint32, am, bm []bool, lo, hi int) (score float64, aoff, boff int) {
+	score, aoff, boff = compareFingerprintsMasked(a, b, am, bm, o.matchMinLength, lo, hi)
+	if o.scorer == framesScorer {
+		score = frameScore(a, b, am, bm, aoff, boff, o.matchMinLength, o.frameMaxBits)
+	}
+	return score, aoff, boff
+}
+
+// compareCandidate compares info to oinfo, a candidate returned by candidateFinder.find
+// for info's fingerprint. Only alignments near cand's offset are checked. The returned
+// shift is oinfo's offset relative to info (see compareFingerprintsRange). false is
+// returned if the files weren't compared due to their durations.
+func (o *scanOptions) compareCandidate(info, oinfo *fileInfo, cand candidate) (score float64, shift int, ok bool) {
+	lo, hi := o.offsetRangeNear(cand.offset)
+	if !o.durationsCompatible(info.duration, oinfo.duration) {
+		if o.logDuration {
+			if score, _, _ := o.compare(info.fprint, oinfo.fprint, info.mask, oinfo.mask, lo, hi); score >= o.matchThresh {
+				log.Printf("Skipping %v (%0.1f sec) and %v (%0.1f sec) due to durations (score %0.3f)",
+					info.path, info.duration, oinfo.path, oinfo.duration, score)
 			}
-			if info.id, err = db.save(info); err != nil {
-				return fmt.Errorf("save %q: %v", rel, err)
+		}
+		return 0, 0, false
+	}
+	score, aoff, boff := o.compare(info.fprint, oinfo.fprint, info.mask, oinfo.mask, lo, hi)
+	return score, boff - aoff, true
+}
+
+// scanResult contains the results of scanFiles.
+type scanResult struct {
+	groups    []*group       // groups of similar files
+	contained []*containment // files contained within longer files
+	paths     []string       // paths of all scanned files
+}
+
+// identicalTier is used as group.tier for groups of files with identical contents.
+// The earliest-scanned file in such a group is also compared against other files,
+// so it may additionally appear in a regular group of similar files.
+const identicalTier = "identical"
+
+// group describes a group of similar files.
+type group struct {
+	files   []*fileInfo // sorted by path
+	matches []*match    // directly-matched pairs of files
+	tier    string      // weakest tier among matches (empty if tiers aren't used), or identicalTier
+}
+
+// match describes a pair of matching files.
+type match struct {
+	a, b  *fileInfo // a.path < b.path
+	score float64
+	tier  string // empty if tiers aren't used
+}
+
+// containment describes a file that is contained within a longer file.
+type containment struct {
+	short, long *fileInfo
+	offset      float64 // seconds into long where short starts
+	score       float64 // ratio of identical bits in short
+}
+
+// newCandidateFinder returns a candidateFinder for opts.
+// If opts.cacheLookup is true, a table previously saved to db is loaded.
+func newCandidateFinder(opts *scanOptions, db *audioDB) (candidateFinder, error) {
+	if opts.lshTables > 0 {
+		return newLSHTable(opts.lshTables, opts.lshBits), nil
+	}
+	if opts.cacheLookup {
+		t, err := db.loadLookupTable()
+		if err != nil {
+			return nil, fmt.Errorf("loading lookup table: %v", err)
+		}
+		return t, nil
+	}
+	return newLookupTable(), nil
+}
+
+// scanFiles scans opts.dir and returns groups of similar files.
+func scanFiles(opts *scanOptions, db *audioDB, fps *fpcalcSettings) (*scanResult, error) {
+	lookup, err := newCandidateFinder(opts, db)
+	if err != nil {
+		return nil, err
+	}
+	edges := make(map[fileID][]fileID)
+	scores := make(map[filePair]float64)
+	// A cached lookup table can contain files that haven't been scanned yet (or that
+	// aren't in dir at all), so only compare against files that we've already seen.
+	seen := make(map[fileID]struct{})
+	masks := make(map[fileID][]bool) // non-nil masks of seen files
+	var order []fileID               // scanned files in the order in which they were seen
+	var paths []string               // paths of scanned files
+
+	identical := make(map[fileID][]fileID) // representative -> files with identical contents
+	var reps []fileID                      // keys of identical in the order in which they were seen
+
+	if err := walkFiles(opts.dir, opts, db, fps, func(info *fileInfo, rep fileID) error {
+		// Files with identical contents are grouped without being compared, and the
+		// representative (i.e. the first file that was seen) is compared against
+		// other files.
+		if rep != 0 {
+			if len(identical[rep]) == 0 {
+				reps = append(reps, rep)
 			}
+			identical[rep] = append(identical[rep], info.id)
+			paths = append(paths, info.path)
+			return nil
 		}
 
-		thresh := int(float64(len(info.fprint)) * opts.lookupThresh)
-		for _, oid := range lookup.find(info.fprint, thresh) {
+		for _, cand := range lookup.find(info.fprint, info.mask, opts.lookupThreshFor(info)) {
+			oid := cand.id
+			if _, ok := seen[oid]; !ok {
+				continue
+			}
 			oinfo, err := db.get(oid, "")
 			if err != nil {
 				return err
 			} else if oinfo == nil {
 				return fmt.Errorf("%d not in database", oid)
 			}
-			if ok, err := db.isExcludedPair(info.path, oinfo.path); err != nil {
-				return fmt.Errorf("check %q and %q: %v", info.path, oinfo.path, err)
-			} else if ok {
+			oinfo.mask = masks[oid]
+			score, shift, ok := opts.compareCandidate(info, oinfo, cand)
+			if !ok || score < opts.matchThresh {
 				continue
 			}
-			score, _, _ := compareFingerprints(info.fprint, oinfo.fprint, opts.matchMinLength)
-			if score >= opts.matchThresh {
+			// Tracks from CUE sheets can't be fingerprinted individually with different settings.
+			refingerprint := !isTrackPath(info.path) && !isTrackPath(oinfo.path)
+			if len(fps.ensemble) > 0 && refingerprint {
+				if score, err = ensembleScore(opts, db, fps, info, oinfo, score); err != nil {
+					return err
+				} else if score < opts.matchThresh {
+					continue
+				}
+			}
+			if opts.verifyLength > fps.length && refingerprint {
+				if score, err = verifyMatch(opts, db, fps, info, oinfo, shift); err != nil {
+					return err
+				} else if score < opts.matchThresh {
+					if opts.logVerify {
+						log.Printf("Skipping %v and %v due to full-length score %0.3f", info.path, oinfo.path, score)
+					}
+					continue
+				}
+			}
+			if excl, err := isExcluded(opts, db, info, oinfo, score); err != nil {
+				return err
+			} else if !excl {
 				edges[info.id] = append(edges[info.id], oid)
 				edges[oid] = append(edges[oid], info.id)
+				scores[makeFilePair(info.id, oid)] = score
 			}
 		}
 
-		lookup.add(info.id, info.fprint)
-
-		scanned++
-		if opts.logSec > 0 && time.Now().Sub(lastLog).Seconds() >= float64(opts.logSec) {
-			log.Printf("Scanned %d files", scanned)
-			lastLog = time.Now()
+		if !lookup.has(info.id) {
+			lookup.add(info.id, info.fprint, info.mask)
 		}
-
+		seen[info.id] = struct{}{}
+		if info.mask != nil {
+			masks[info.id] = info.mask
+		}
+		order = append(order, info.id)
+		paths = append(paths, info.path)
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	if opts.logSec > 0 {
-		log.Printf("Finished scanning %d files", scanned)
+	if opts.cacheLookup {
+		if err := db.saveLookupTable(lookup.(*lookupTable)); err != nil {
+			return nil, fmt.Errorf("saving lookup table: %v", err)
+		}
 	}
 
-	var groups [][]*fileInfo
-GroupLoop:
-	for _, comp := range components(edges) {
-		group := make([]*fileInfo, len(comp))
-		for i, id := range comp {
+	res := scanResult{paths: paths}
+	if opts.findContained {
+		if res.contained, err = findContained(opts, db, lookup, order, masks, edges); err != nil {
+			return nil, err
+		}
+	}
+
+	comps, err := clusterFiles(opts.cluster, edges, scores)
+	if err != nil {
+		return nil, err
+	}
+	for _, comp := range comps {
+		infos := make(map[fileID]*fileInfo, len(comp))
+		for _, id := range comp {
 			info, err := db.get(id, "")
 			if err != nil {
 				return nil, fmt.Errorf("getting info for %d: %v", id, err)
 			} else if info == nil {
 				return nil, fmt.Errorf("no info for %d", id)
 			}
-			group[i] = info
+			infos[id] = info
 		}
 		// It's possible for a previously-excluded pair to get joined into the same group
-		// by a newly-added song. Throw the whole group out if any of its members were
-		// previously excluded.
-		for i := 0; i < len(group)-1; i++ {
-			for j := i + 1; j < len(group); j++ {
-				if ok, err := db.isExcludedPair(group[i].path, group[j].path); err != nil {
+		// by a newly-added song. Split the group so that excluded pairs end up in
+		// different groups.
+		// Pairs that weren't directly matched are excluded regardless of their tiers.
+		excluded := make(map[filePair]struct{})
+		for i := 0; i < len(comp)-1; i++ {
+			for j := i + 1; j < len(comp); j++ {
+				pair := makeFilePair(comp[i], comp[j])
+				if excl, err := isExcluded(opts, db, infos[comp[i]], infos[comp[j]], scores[pair]); err != nil {
 					return nil, err
-				} else if ok {
-					continue GroupLoop
+				} else if excl {
+					excluded[pair] = struct{}{}
+				}
+			}
+		}
+		subs := [][]fileID{comp}
+		if len(excluded) > 0 {
+			subs = splitExcluded(comp, edges, scores, excluded)
+			if opts.logSec > 0 {
+				paths := make([]string, len(comp))
+				for i, id := range comp {
+					paths[i] = infos[id].path
 				}
+				sort.Strings(paths)
+				log.Printf("Split group with excluded pairs into %d group(s): %v", len(subs), strings.Join(paths, ", "))
 			}
 		}
-		sort.Slice(group, func(i, j int) bool { return group[i].path < group[j].path })
-		groups = append(groups, group)
+		for _, sub := range subs {
+			res.groups = append(res.groups, newGroup(opts, sub, infos, scores))
+		}
 	}
-	sort.Slice(groups, func(i, j int) bool { return groups[i][0].path < groups[j][0].path })
-	return groups, nil
+	for _, rep := range reps {
+		groups, err := identicalGroups(opts, db, append([]fileID{rep}, identical[rep]...))
+		if err != nil {
+			return nil, err
+		}
+		res.groups = append(res.groups, groups...)
+	}
+	sort.Slice(res.groups, func(i, j int) bool {
+		gi, gj := res.groups[i], res.groups[j]
+		if pi, pj := gi.files[0].path, gj.files[0].path; pi != pj {
+			return pi < pj
+		}
+		return gi.tier < gj.tier // identical groups can start with the same file
+	})
+	return &res, nil
 }
 
-// compareFingerprints returns the ratio of identical bits in a and b to the
-// total bits in the longer (or shorter if minLength is true) of the two.
-// All possible alignments are checked, and the highest ratio is returned.
-func compareFingerprints(a, b []uint32, minLength bool) (ratio float64, aoff, boff int) {
-	if len(a) == 0 || len(b) == 0 {
-		return 0, 0, 0
+// identicalGroups returns groups of the files in ids, which all have identical contents.
+// Like other groups, groups are split so that excluded pairs end up in different groups.
+func identicalGroups(opts *scanOptions, db *audioDB, ids []fileID) ([]*group, error) {
+	infos := make(map[fileID]*fileInfo, len(ids))
+	for _, id := range ids {
+		info, err := db.get(id, "")
+		if err != nil {
+			return nil, fmt.Errorf("getting info for %d: %v", id, err)
+		} else if info == nil {
+			return nil, fmt.Errorf("no info for %d", id)
+		}
+		infos[id] = info
 	}
 
-	count := func(a, b []uint32) int {
-		var cnt int
-		for i := 0; i < len(a) && i < len(b); i++ {
-			cnt += 32 - bits.OnesCount32(a[i]^b[i])
+	edges := make(map[fileID][]fileID)
+	scores := make(map[filePair]float64)
+	excluded := make(map[filePair]struct{})
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			pair := makeFilePair(a, b)
+			edges[a] = append(edges[a], b)
+			edges[b] = append(edges[b], a)
+			scores[pair] = 1
+			if excl, err := isExcluded(opts, db, infos[a], infos[b], 1); err != nil {
+				return nil, err
+			} else if excl {
+				excluded[pair] = struct{}{}
+			}
 		}
-		return cnt
+	}
+	subs := [][]fileID{ids}
+	if len(excluded) > 0 {
+		subs = splitExcluded(ids, edges, scores, excluded)
 	}
 
-	best := count(a, b)
-	for i := 1; i < len(a); i++ {
-		if cnt := count(a[i:], b); cnt > best {
-			best = cnt
-			aoff, boff = i, 0
+	groups := make([]*group, 0, len(subs))
+	for _, sub := range subs {
+		g := &group{tier: identicalTier}
+		for _, id := range sub {
+			g.files = append(g.files, infos[id])
 		}
+		sort.Slice(g.files, func(i, j int) bool { return g.files[i].path < g.files[j].path })
+		groups = append(groups, g)
 	}
-	for i := 1; i < len(b); i++ {
-		if cnt := count(a, b[i:]); cnt > best {
-			best = cnt
-			aoff, boff = 0, i
-		}
+	return groups, nil
+}
+
+// newGroup returns a group containing the files in ids. infos contains information
+// about each file and scores contains the scores of matched pairs of files.
+func newGroup(opts *scanOptions, ids []fileID, infos map[fileID]*fileInfo, scores map[filePair]float64) *group {
+	var g group
+	for _, id := range ids {
+		g.files = append(g.files, infos[id])
 	}
+	sort.Slice(g.files, func(i, j int) bool { return g.files[i].path < g.files[j].path })
 
-	total := len(a)
-	if (minLength && len(b) < total) || (!minLength && len(b) > total) {
-		total = len(b)
+	weakest := -1
+	for i := 0; i < len(ids)-1; i++ {
+		for j := i + 1; j < len(ids); j++ {
+			score, ok := scores[makeFilePair(ids[i], ids[j])]
+			if !ok {
+				continue
+			}
+			a, b := infos[ids[i]], infos[ids[j]]
+			if b.path < a.path {
+				a, b = b, a
+			}
+			g.matches = append(g.matches, &match{a, b, score, opts.tierName(score)})
+			if ti := opts.tierIndex(score); ti > weakest {
+				weakest = ti
+			}
+		}
+	}
+	sort.Slice(g.matches, func(i, j int) bool {
+		mi, mj := g.matches[i], g.matches[j]
+		if mi.a.path != mj.a.path {
+			return mi.a.path < mj.a.path
+		}
+		return mi.b.path < mj.b.path
+	})
+	if weakest >= 0 {
+		g.tier = opts.tiers[weakest].name
 	}
-	return float64(best) / float64(32*total), aoff, boff
+	return &g
 }
 
-// components returns all components from the undirected graph described by edges.
-func components(edges map[fileID][]fileID) [][]fileID {
-	visited := make(map[fileID]struct{})
+// verifyMatch compares longer fingerprints of a and b (see scanOptions.verifyLength),
+// which matched with b shifted by shift positions relative to a in their regular fingerprints.
+// The longer fingerprints use the same algorithm as segments in db, so they're masked too.
+func verifyMatch(opts *scanOptions, db *audioDB, fps *fpcalcSettings, a, b *fileInfo, shift int) (float64, error) {
+	settings := fps.withAlgorithm(fps.algorithm)
+	settings.length = opts.verifyLength
+	fa, err := extraFingerprint(opts, db, settings, a)
+	if err != nil {
+		return 0, err
+	}
+	fb, err := extraFingerprint(opts, db, settings, b)
+	if err != nil {
+		return 0, err
+	}
+	lo, hi := opts.offsetRangeNear(shift)
+	score, _, _ := opts.compare(fa, fb, db.mask(fa), db.mask(fb), lo, hi)
+	return score, nil
+}
 
-	var search func(fileID) []fileID
-	search = func(src fileID) []fileID {
-		if _, ok := visited[src]; ok {
-			return nil
+// ensembleScore combines score, the score of a and b's regular fingerprints, with
+// the scores of fingerprints computed using fps.ensemble's algorithms.
+// Segments in db are only fingerprinted using fps.algorithm, so they can't be used
+// to mask the other algorithms' fingerprints.
+func ensembleScore(opts *scanOptions, db *audioDB, fps *fpcalcSettings, a, b *fileInfo, score float64) (float64, error) {
+	lo, hi := opts.offsetRange()
+	combined := score
+	for _, alg := range fps.ensemble {
+		settings := fps.withAlgorithm(alg)
+		fa, err := extraFingerprint(opts, db, settings, a)
+		if err != nil {
+			return 0, err
 		}
-		visited[src] = struct{}{}
-		comp := []fileID{src}
-		for _, dst := range edges[src] {
-			comp = append(comp, search(dst)...)
+		fb, err := extraFingerprint(opts, db, settings, b)
+		if err != nil {
+			return 0, err
 		}
-		return comp
+		// Different algorithms may produce differently-aligned fingerprints
+		// (e.g. by trimming leading silence), so check all alignments.
+		s, _, _ := opts.compare(fa, fb, nil, nil, lo, hi)
+		switch opts.ensembleCombine {
+		case minCombine:
+			combined = math.Min(combined, s)
+		case meanCombine:
+			combined += s
+		}
+	}
+	if opts.ensembleCombine == meanCombine {
+		combined /= float64(len(fps.ensemble) + 1)
+	}
+	return combined, nil
+}
+
+// extraFingerprint returns a fingerprint of info's file computed using settings.
+// Fingerprints are cached in db. If the file is too short to be fingerprinted,
+// an empty fingerprint is returned.
+func extraFingerprint(opts *scanOptions, db *audioDB, settings *fpcalcSettings, info *fileInfo) ([]uint32, error) {
+	if fprint, err := db.getExtraFingerprint(info.path, settings); err != nil {
+		return nil, fmt.Errorf("get extra fingerprint for %q: %v", info.path, err)
+	} else if fprint != nil {
+		return fprint, nil
+	}
+	fprint := []uint32{}
+	if res, err := fingerprintPath(opts.dir, info.path, settings); err == nil {
+		fprint = res.Fingerprint
+	} else if err != errEmptyFingerprint {
+		return nil, fmt.Errorf("%v: %v", info.path, err)
+	}
+	if err := db.saveExtraFingerprint(info.path, settings, fprint); err != nil {
+		return nil, fmt.Errorf("save extra fingerprint for %q: %v", info.path, err)
+	}
+	return fprint, nil
+}
+
+// isExcluded returns true if a and b shouldn't be matched with the supplied score
+// due to an exclusion saved in db.
+func isExcluded(opts *scanOptions, db *audioDB, a, b *fileInfo, score float64) (bool, error) {
+	ok, tier, err := db.getExcludedPair(a.path, b.path)
+	if err != nil {
+		return false, fmt.Errorf("check %q and %q: %v", a.path, b.path, err)
+	}
+	return ok && opts.excludedAt(tier, score), nil
+}
+
+// findContained looks for files in ids that are contained within longer files in ids.
+// Every file must have already been added to lookup. masks contains the files' non-nil
+// masks. Pairs of files that are already connected in edges are skipped.
+func findContained(opts *scanOptions, db *audioDB, lookup candidateFinder,
+	ids []fileID, masks map[fileID][]bool, edges map[fileID][]fileID) ([]*containment, error) {
+	scanned := make(map[fileID]struct{}, len(ids))
+	for _, id := range ids {
+		scanned[id] = struct{}{}
 	}
 
-	var comps [][]fileID
-	for src := range edges {
-		if _, ok := visited[src]; !ok {
-			comps = append(comps, search(src))
+	var contained []*containment
+	for _, id := range ids {
+		info, err := db.get(id, "")
+		if err != nil {
+			return nil, err
+		} else if info == nil {
+			return nil, fmt.Errorf("%d not in database", id)
+		}
+		info.mask = masks[id]
+
+		// Look for longer files sharing enough of this file's values at the same offset.
+	CandLoop:
+		for _, cand := range lookup.find(info.fprint, info.mask, opts.lookupThreshFor(info)) {
+			if _, ok := scanned[cand.id]; !ok || cand.id == id {
+				continue
+			}
+			for _, oid := range edges[id] {
+				if oid == cand.id {
+					continue CandLoop
+				}
+			}
+			oinfo, err := db.get(cand.id, "")
+			if err != nil {
+				return nil, err
+			} else if oinfo == nil {
+				return nil, fmt.Errorf("%d not in database", cand.id)
+			}
+			oinfo.mask = masks[cand.id]
+			if len(oinfo.fprint) <= len(info.fprint) {
+				continue
+			}
+			lo, hi := opts.offsetRangeNear(cand.offset)
+			score, off := compareContained(info.fprint, oinfo.fprint, info.mask, oinfo.mask, lo, hi)
+			if opts.scorer == framesScorer {
+				score = frameScore(info.fprint, oinfo.fprint, info.mask, oinfo.mask, 0, off, true, opts.frameMaxBits)
+			}
+			if score < opts.matchThresh {
+				continue
+			}
+			if excl, err := isExcluded(opts, db, info, oinfo, score); err != nil {
+				return nil, err
+			} else if !excl {
+				contained = append(contained, &containment{
+					short:  info,
+					long:   oinfo,
+					offset: float64(off) / fingerprintRate,
+					score:  score,
+				})
+			}
 		}
 	}
-	return comps
+
+	sort.Slice(contained, func(i, j int) bool {
+		ci, cj := contained[i], contained[j]
+		if ci.long.path != cj.long.path {
+			return ci.long.path < cj.long.path
+		}
+		if ci.offset != cj.offset {
+			return ci.offset < cj.offset
+		}
+		return ci.short.path < cj.short.path
+	})
+	return contained, nil
 }
@@ -5,69 +5,135 @@ package main
 
 import (
 	"reflect"
-	"sort"
+	"strings"
 	"testing"
 )
 
-func TestCompareFingerprints(t *testing.T) {
+func TestScanOptions_DurationsCompatible(t *testing.T) {
 	for _, tc := range []struct {
-		a, b       []uint32
-		minLength  bool
-		score      float64
-		aoff, boff int
+		diff, ratio float64
+		a, b        float64
+		want        bool
 	}{
-		{
-			[]uint32{0x0000ffe4},
-			[]uint32{0xffff0f14},
-			false, 8.0 / 32, 0, 0,
-		},
-		{
-			[]uint32{0xfffffffe, 0x80000001},
-			[]uint32{0x7fffffff, 0xf0000001},
-			false, 59.0 / 64, 0, 0,
-		},
-		{
-			[]uint32{0x00000000, 0x01010101, 0xffffffff, 0xcafebeef},
-			[]uint32{0x01010101, 0xffffffff, 0xcafebeef, 0x00000000},
-			false, 96.0 / 128, 1, 0,
-		},
-		{
-			[]uint32{0xffffffff, 0x01010101},
-			[]uint32{0x00000000, 0xffffffff, 0x01010101},
-			false, 64.0 / 96, 0, 1,
-		},
-		{
-			[]uint32{0x00000000, 0xffffffff, 0x01010101},
-			[]uint32{0xffffffff, 0x01010101},
-			true, 64.0 / 64, 1, 0,
-		},
+		{0, 0, 30, 360, true},
+		{5, 0, 30, 34, true},
+		{5, 0, 30, 36, false},
+		{0, 0.9, 360, 330, true},
+		{0, 0.9, 360, 300, false},
+		{0, 0.9, 300, 360, false},
+		{5, 0.9, 3, 7, true},     // diff satisfied
+		{5, 0.9, 360, 340, true}, // ratio satisfied
+		{5, 0.9, 30, 360, false},
+		{0, 0.9, 0, 0, true},
 	} {
-		if score, aoff, boff := compareFingerprints(tc.a, tc.b, tc.minLength); score != tc.score || aoff != tc.aoff || boff != tc.boff {
-			t.Errorf("compareFingerprints(%v, %v, %v) = (%0.3f, %d, %d); want (%0.3f, %d, %d)",
-				tc.a, tc.b, tc.minLength, score, aoff, boff, tc.score, tc.aoff, tc.boff)
+		opts := scanOptions{durationDiff: tc.diff, durationRatio: tc.ratio}
+		if got := opts.durationsCompatible(tc.a, tc.b); got != tc.want {
+			t.Errorf("durationsCompatible(%v, %v) with diff %v and ratio %v = %v; want %v",
+				tc.a, tc.b, tc.diff, tc.ratio, got, tc.want)
 		}
 	}
 }
 
-func TestComponents(t *testing.T) {
-	edges := make(map[fileID][]fileID)
-	add := func(a, b fileID) {
-		edges[a] = append(edges[a], b)
-		edges[b] = append(edges[b], a)
+func TestParseTiers(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []tier // nil for error
+	}{
+		{"dup=0.95", []tier{{"dup", 0.95}}},
+		{"remaster=0.8,dup=0.95", []tier{{"dup", 0.95}, {"remaster", 0.8}}},
+		{"dup", nil},
+		{"=0.95", nil},
+		{"dup=1.5", nil},
+		{"dup=0", nil},
+		{"dup=abc", nil},
+		{"dup=0.95,dup=0.8", nil},
+		{"a=0.9,b=0.9", nil},
+		{"identical=0.99", nil},
+	} {
+		got, err := parseTiers(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parseTiers(%q) unexpectedly succeeded", tc.in)
+			}
+		} else if err != nil {
+			t.Errorf("parseTiers(%q) failed: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseTiers(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestScanOptions_ExcludedAt(t *testing.T) {
+	opts := scanOptions{tiers: []tier{{"dup", 0.95}, {"remaster", 0.8}}}
+	for _, tc := range []struct {
+		tier  string
+		score float64
+		want  bool
+	}{
+		{"", 0.99, true},
+		{"unknown", 0.99, true},
+		{"dup", 0.99, true},
+		{"dup", 0.85, true},
+		{"remaster", 0.99, false},
+		{"remaster", 0.85, true},
+		{"remaster", 0.5, true},
+	} {
+		if got := opts.excludedAt(tc.tier, tc.score); got != tc.want {
+			t.Errorf("excludedAt(%q, %v) = %v; want %v", tc.tier, tc.score, got, tc.want)
+		}
+	}
+}
+
+func TestScanFiles_Identical(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.mp3": "abc", "b.mp3": "abc", "c.mp3": "xyz!"})
+
+	// c.mp3 has the same fingerprint as a.mp3 but different contents.
+	// b.mp3 is a copy of a.mp3, so it should reuse a.mp3's fingerprint.
+	fprint := make([]uint32, 64)
+	for i := range fprint {
+		fprint[i] = uint32(i) * 0x9e3779b9
+	}
+	db := newTestDB(t)
+	for _, p := range []string{"a.mp3", "c.mp3"} {
+		if _, err := db.save(&fileInfo{path: p, fprint: fprint}); err != nil {
+			t.Fatalf("save %q failed: %v", p, err)
+		}
+	}
+
+	scan := func() []string {
+		opts := defaultScanOptions()
+		opts.dir = dir
+		opts.skipBadFiles = false
+		if err := opts.finish(); err != nil {
+			t.Fatal("finish failed: ", err)
+		}
+		opts.logSec = 0
+		res, err := scanFiles(opts, db, defaultFpcalcSettings())
+		if err != nil {
+			t.Fatal("scanFiles failed: ", err)
+		}
+		var groups []string
+		for _, g := range res.groups {
+			var paths []string
+			for _, info := range g.files {
+				paths = append(paths, info.path)
+			}
+			groups = append(groups, g.tier+":"+strings.Join(paths, ","))
+		}
+		return groups
+	}
+
+	// a.mp3 is listed in both its identical group and its regular group.
+	if got, want := scan(), []string{":a.mp3,c.mp3", "identical:a.mp3,b.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanFiles returned %q; want %q", got, want)
 	}
-	add(1, 2)
-	add(1, 3)
-	add(2, 3)
-	add(3, 4)
-	add(5, 6)
-	add(5, 7)
 
-	got := components(edges)
-	for i := range got {
-		sort.Slice(got[i], func(a, b int) bool { return got[i][a] < got[i][b] })
+	// Identical files should be split if they were excluded.
+	if err := db.saveExcludedPair("a.mp3", "b.mp3", ""); err != nil {
+		t.Fatal("saveExcludedPair failed: ", err)
 	}
-	sort.Slice(got, func(a, b int) bool { return got[a][0] < got[b][0] })
-	if want := [][]fileID{{1, 2, 3, 4}, {5, 6, 7}}; !reflect.DeepEqual(got, want) {
-		t.Errorf("components(...) = %v; want %v", got, want)
+	if got, want := scan(), []string{":a.mp3,c.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanFiles after exclusion returned %q; want %q", got, want)
 	}
 }
@@ -0,0 +1,73 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import "math/bits"
+
+const (
+	// segmentThresh is the minimum ratio of identical bits for a region of a
+	// fingerprint to be considered a match for a known segment.
+	segmentThresh = 0.85
+	// segmentMinOverlap is the minimum ratio of a region's length to the shorter of
+	// the segment and the fingerprint for the region to be masked.
+	segmentMinOverlap = 0.5
+)
+
+// segmentMasker finds regions of fingerprints that match known segments (e.g. intros
+// and station IDs shared by many files) so that they can be ignored when comparing files.
+type segmentMasker struct {
+	table *lookupTable
+	segs  map[fileID][]uint32 // keyed by IDs used in table
+}
+
+// newSegmentMasker returns a segmentMasker that looks for the supplied segment fingerprints.
+func newSegmentMasker(segs [][]uint32) *segmentMasker {
+	m := &segmentMasker{table: newLookupTable(), segs: make(map[fileID][]uint32, len(segs))}
+	for i, seg := range segs {
+		id := fileID(i + 1)
+		m.table.add(id, seg, nil)
+		m.segs[id] = seg
+	}
+	return m
+}
+
+// mask returns a slice with the same length as fprint that is true at positions
+// within regions matching known segments. nil is returned if no regions match.
+// Only the best-matching region is found for each segment.
+func (m *segmentMasker) mask(fprint []uint32) []bool {
+	var mask []bool
+	for _, cand := range m.table.find(fprint, nil, 1) {
+		// fprint[i] is aligned with seg[i+cand.offset].
+		seg := m.segs[cand.id]
+		start, end := -cand.offset, len(seg)-cand.offset
+		if start < 0 {
+			start = 0
+		}
+		if end > len(fprint) {
+			end = len(fprint)
+		}
+		n := end - start
+		min := len(seg)
+		if len(fprint) < min {
+			min = len(fprint)
+		}
+		if n <= 0 || float64(n) < segmentMinOverlap*float64(min) {
+			continue
+		}
+		var same int
+		for i := start; i < end; i++ {
+			same += 32 - bits.OnesCount32(fprint[i]^seg[i+cand.offset])
+		}
+		if float64(same)/float64(32*n) < segmentThresh {
+			continue
+		}
+		if mask == nil {
+			mask = make([]bool, len(fprint))
+		}
+		for i := start; i < end; i++ {
+			mask[i] = true
+		}
+	}
+	return mask
+}
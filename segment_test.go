@@ -0,0 +1,120 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentMasker(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	intro := randFingerprint(r, 100)
+	outro := randFingerprint(r, 50)
+	m := newSegmentMasker([][]uint32{intro, outro})
+
+	// Files sharing the intro but with different content should only match when
+	// the intro is masked.
+	a := append(append([]uint32{}, noisyFingerprint(r, intro, 0, 6)...), randFingerprint(r, 200)...)
+	b := append(append([]uint32{}, intro...), randFingerprint(r, 200)...)
+	am, bm := m.mask(a), m.mask(b)
+	for i, want := range []int{100, 100} {
+		mask := [][]bool{am, bm}[i]
+		var n int
+		for j, v := range mask {
+			if v {
+				n++
+				if j >= 100 {
+					t.Errorf("Position %d masked in file %d", j, i)
+				}
+			}
+		}
+		if n != want {
+			t.Errorf("%d position(s) masked in file %d; want %d", n, i, want)
+		}
+	}
+	if score, _, _ := compareFingerprintsMasked(a, b, am, bm, false, -100, 100); score >= 0.8 {
+		t.Errorf("Masked score for files with different content is %0.3f; want < 0.8", score)
+	}
+
+	// Files with the same content but only one outro should match when the outro is masked.
+	content := randFingerprint(r, 200)
+	c := append(append([]uint32{}, content...), outro...)
+	cm := m.mask(c)
+	if cm == nil || !cm[200] || cm[199] {
+		t.Errorf("Outro not masked in %v", cm)
+	}
+	if score, _, _ := compareFingerprintsMasked(content, c, nil, cm, false, -100, 100); score != 1 {
+		t.Errorf("Masked score for files with same content is %0.3f; want 1", score)
+	}
+
+	if mask := m.mask(randFingerprint(r, 300)); mask != nil {
+		t.Errorf("Unrelated fingerprint unexpectedly masked: %v", mask)
+	}
+}
+
+func TestAudioDB_SaveSegment(t *testing.T) {
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), defaultFpcalcSettings())
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	r := rand.New(rand.NewSource(1))
+	intro := randFingerprint(r, 100)
+	info := &fileInfo{path: "a.mp3", fprint: append(append([]uint32{}, intro...), randFingerprint(r, 100)...)}
+	if info.id, err = db.save(info); err != nil {
+		t.Fatal("save failed: ", err)
+	}
+	if mask := db.mask(info.fprint); mask != nil {
+		t.Fatal("mask returned non-nil mask before segment was saved")
+	}
+	if err := db.saveSegment("intro.mp3", intro); err != nil {
+		t.Fatal("saveSegment failed: ", err)
+	}
+	if mask := db.mask(info.fprint); mask == nil || !mask[0] || !mask[99] || mask[100] {
+		t.Fatalf("mask returned %v; want first 100 positions masked", mask)
+	}
+}
+
+func TestVerifyMatch_Masked(t *testing.T) {
+	fps := defaultFpcalcSettings()
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), fps)
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	// Both files start with the same intro but are otherwise unrelated.
+	r := rand.New(rand.NewSource(1))
+	intro := randFingerprint(r, 100)
+	opts := defaultScanOptions()
+	opts.verifyLength = 60
+	settings := fps.withAlgorithm(fps.algorithm)
+	settings.length = opts.verifyLength
+	a, b := &fileInfo{path: "a.mp3"}, &fileInfo{path: "b.mp3"}
+	for _, info := range []*fileInfo{a, b} {
+		fprint := append(append([]uint32{}, intro...), randFingerprint(r, 100)...)
+		if err := db.saveExtraFingerprint(info.path, settings, fprint); err != nil {
+			t.Fatalf("saveExtraFingerprint(%q) failed: %v", info.path, err)
+		}
+	}
+
+	unmasked, err := verifyMatch(opts, db, fps, a, b, 0)
+	if err != nil {
+		t.Fatal("verifyMatch failed: ", err)
+	}
+	if err := db.saveSegment("intro.mp3", intro); err != nil {
+		t.Fatal("saveSegment failed: ", err)
+	}
+	masked, err := verifyMatch(opts, db, fps, a, b, 0)
+	if err != nil {
+		t.Fatal("verifyMatch failed: ", err)
+	}
+	if unmasked < 0.7 || masked > 0.6 {
+		t.Errorf("verifyMatch returned %0.3f before saving segment and %0.3f after; want >= 0.7 and <= 0.6",
+			unmasked, masked)
+	}
+}
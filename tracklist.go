@@ -0,0 +1,76 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import "sort"
+
+// maxMixLength is the maximum duration in seconds of long files passed to findTracks.
+const maxMixLength = 6 * 60 * 60
+
+// trackMatch describes a file found within a long file (e.g. a DJ mix).
+type trackMatch struct {
+	info  *fileInfo
+	start float64 // seconds into long file where info starts (may be negative)
+	score float64 // best score among matching windows
+}
+
+// findTracks looks for files from ref within fprint, a fingerprint of a long file.
+// fprint is split into overlapping windows that are longer than the fingerprints in
+// ref, so every file in fprint lies entirely within at least one window. Each window
+// is checked separately, with scores computed relative to the shorter fingerprint.
+// Matches of the same file at similar positions in consecutive windows are merged.
+// The returned matches are sorted by ascending start time.
+func findTracks(opts *scanOptions, ref *reference, fprint []uint32, fps *fpcalcSettings) ([]*trackMatch, error) {
+	n := secondsToValues(fps.length) // max length of fingerprints in ref
+	step := n / 2
+	if step < 1 {
+		step = 1
+	}
+	window := n + step
+
+	// The windows' durations don't reflect the actual files' durations, and files
+	// can start anywhere within a window.
+	wopts := *opts
+	wopts.durationDiff = 0
+	wopts.durationRatio = 0
+	wopts.maxOffset = 0
+	wopts.matchMinLength = true
+	// The lookup threshold is relative to the query's length, but at most n values
+	// can be shared with a file.
+	wopts.lookupThresh = opts.lookupThresh * float64(n) / float64(window)
+
+	var tracks []*trackMatch
+	last := make(map[fileID]*trackMatch) // most recent match for each file
+	for wstart := 0; wstart < len(fprint); wstart += step {
+		wend := wstart + window
+		if wend > len(fprint) {
+			wend = len(fprint)
+		}
+		wfp := fprint[wstart:wend]
+		winfo := &fileInfo{fprint: wfp, mask: ref.db.mask(wfp), duration: float64(len(wfp)) / fingerprintRate}
+		matches, err := ref.query(&wopts, winfo)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			// m.offset is the position in the file where the window starts.
+			start := float64(wstart)/fingerprintRate - m.offset
+			if t := last[m.info.id]; t != nil && start-t.start < fps.length && t.start-start < fps.length {
+				if m.score > t.score {
+					t.score = m.score
+				}
+				continue
+			}
+			t := &trackMatch{info: m.info, start: start, score: m.score}
+			tracks = append(tracks, t)
+			last[m.info.id] = t
+		}
+		if wend == len(fprint) {
+			break
+		}
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].start < tracks[j].start })
+	return tracks, nil
+}
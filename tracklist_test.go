@@ -0,0 +1,77 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindTracks(t *testing.T) {
+	fps := defaultFpcalcSettings()
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), fps)
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	defer db.close()
+
+	// The database only contains the beginning of each track.
+	r := rand.New(rand.NewSource(1))
+	n := secondsToValues(fps.length)
+	full := make(map[string][]uint32)
+	for _, p := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		full[p] = randFingerprint(r, 3*n)
+		if _, err := db.save(&fileInfo{path: p, duration: 60, fprint: full[p][:n]}); err != nil {
+			t.Fatalf("save %q failed: %v", p, err)
+		}
+	}
+
+	opts := defaultScanOptions()
+	if err := opts.finish(); err != nil {
+		t.Fatal("finish failed: ", err)
+	}
+	ref, err := loadReference(opts, db, "", fps)
+	if err != nil {
+		t.Fatal("loadReference failed: ", err)
+	}
+
+	// Start the mix with varying amounts of other audio so the tracks aren't aligned
+	// with findTracks's windows, and then play b.mp3 and a.mp3.
+	for pad := 0; pad < 2*n; pad++ {
+		var mix []uint32
+		mix = append(mix, randFingerprint(r, pad)...)
+		mix = append(mix, full["b.mp3"]...)
+		mix = append(mix, full["a.mp3"]...)
+		mix = noisyFingerprint(r, mix, 0, 7)
+
+		tracks, err := findTracks(opts, ref, mix, fps)
+		if err != nil {
+			t.Fatalf("findTracks failed with pad %d: %v", pad, err)
+		}
+		want := []struct {
+			path  string
+			start float64
+		}{
+			{"b.mp3", float64(pad) / fingerprintRate},
+			{"a.mp3", float64(pad+3*n) / fingerprintRate},
+		}
+		if len(tracks) != len(want) {
+			var got []string
+			for _, t := range tracks {
+				got = append(got, t.info.path)
+			}
+			t.Errorf("findTracks returned %q with pad %d; want %v", got, pad, want)
+			continue
+		}
+		for i, w := range want {
+			if tr := tracks[i]; tr.info.path != w.path || math.Abs(tr.start-w.start) > 0.001 ||
+				tr.score < opts.matchThresh {
+				t.Errorf("Track %d with pad %d is %v at %0.3f with score %0.3f; want %v at %0.3f",
+					i, pad, tr.info.path, tr.start, tr.score, w.path, w.start)
+			}
+		}
+	}
+}
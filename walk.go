@@ -0,0 +1,682 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// archiveSep separates the path of a .zip archive from the path of a file within it,
+// e.g. "album.zip!/01-song.mp3".
+const archiveSep = "!/"
+
+// archiveRegexp matches the names of archives that are walked by walkFiles.
+var archiveRegexp = regexp.MustCompile(`(?i)\.zip$`)
+
+// walkFiles walks dir and passes information about each audio file to fn.
+// New files are fingerprinted and saved to db. Files within .zip archives are
+// also passed (see archiveSep). Tracks listed in CUE sheets are passed as separate
+// files (see walkCueSheet), and the audio files containing them are skipped.
+// If opts.files is non-nil, only the listed files and directories are walked.
+// Files with the same contents as earlier files (e.g. hardlinks or byte-identical
+// copies) reuse the earlier files' fingerprints, and the earliest file's ID is
+// passed to fn as rep. rep is 0 for other files.
+func walkFiles(dir string, opts *scanOptions, db *audioDB, fps *fpcalcSettings,
+	fn func(info *fileInfo, rep fileID) error) error {
+	// fs.WalkDir doesn't follow symlinks, so do it manually first.
+	evalDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	w := &fileWalker{
+		opts:     opts,
+		db:       db,
+		fps:      fps,
+		fn:       fn,
+		cueFiles: make(map[string]struct{}),
+		reported: make(map[string]struct{}),
+		ignores:  make(map[string][]ignoreRule),
+		dirs:     make(map[fileKey]struct{}),
+		files:    make(map[fileKey]bool),
+		inodes:   make(map[fileKey]fileID),
+		sizes:    make(map[int64][]fileID),
+		lastLog:  time.Now(),
+	}
+	fsys := newDirFS(evalDir)
+	if opts.files == nil {
+		if err := w.walk(fsys, "", "."); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range opts.files {
+			rel, err := relPath(dir, evalDir, p)
+			if err != nil {
+				if err := w.bad(p, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.walk(fsys, "", rel); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.logSec > 0 {
+		log.Printf("Finished scanning %d files", w.scanned)
+	}
+	return nil
+}
+
+// relPath returns p, a path from scanOptions.files, as a slash-separated path
+// relative to dir. evalDir is dir with symlinks evaluated.
+func relPath(dir, evalDir, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		var err error
+		if p, err = filepath.Abs(filepath.Join(dir, p)); err != nil {
+			return "", err
+		}
+	}
+	for _, d := range []string{dir, evalDir} {
+		abs, err := filepath.Abs(d)
+		if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(abs, p); err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), nil
+		}
+	}
+	return "", fmt.Errorf("not in %v", dir)
+}
+
+// readFileList reads a list of paths from r for scanOptions.files.
+// Paths are separated by NUL bytes if any are present (e.g. from "find -print0")
+// and by newlines otherwise, in which case lines starting with '#' (e.g. in M3U
+// playlists) are skipped.
+func readFileList(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	if bytes.IndexByte(b, 0) >= 0 {
+		for _, p := range strings.Split(string(b), "\x00") {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		return paths, nil
+	}
+	for _, ln := range strings.Split(string(b), "\n") {
+		if ln = strings.TrimRight(ln, "\r"); ln != "" && ln[0] != '#' {
+			paths = append(paths, ln)
+		}
+	}
+	return paths, nil
+}
+
+// fileWalker holds state used by walkFiles.
+type fileWalker struct {
+	opts     *scanOptions
+	db       *audioDB
+	fps      *fpcalcSettings
+	fn       func(*fileInfo, fileID) error
+	cueFiles map[string]struct{}     // audio files with tracks in CUE sheets
+	reported map[string]struct{}     // files passed to fn
+	ignores  map[string][]ignoreRule // dir -> rules from its ignoreFile and opts.skipRules
+	dirs     map[fileKey]struct{}    // directories visited when following symlinks
+	files    map[fileKey]bool        // files seen when following symlinks; true if reached via symlink
+	links    int                     // number of symlinks followed to reach current directory
+	inodes   map[fileKey]fileID      // reported files without identical earlier files
+	sizes    map[int64][]fileID      // sizes of files in inodes
+	scanned  int                     // files passed to fn
+	lastLog  time.Time               // last time that progress was logged
+}
+
+// report passes info and rep to w.fn and periodically logs progress.
+// Files that were already reported are skipped.
+func (w *fileWalker) report(info *fileInfo, rep fileID) error {
+	if _, ok := w.reported[info.path]; ok {
+		return nil
+	}
+	w.reported[info.path] = struct{}{}
+	if err := w.fn(info, rep); err != nil {
+		return err
+	}
+	w.scanned++
+	if w.opts.logSec > 0 && time.Now().Sub(w.lastLog).Seconds() >= float64(w.opts.logSec) {
+		log.Printf("Scanned %d files", w.scanned)
+		w.lastLog = time.Now()
+	}
+	return nil
+}
+
+// bad handles a problem with the file at name. If opts.skipBadFiles is true,
+// the problem is logged and nil is returned.
+func (w *fileWalker) bad(name string, err error) error {
+	if w.opts.skipBadFiles {
+		log.Printf("Skipping %v: %v", name, err)
+		return nil
+	}
+	return fmt.Errorf("%v: %v", name, err)
+}
+
+// walk walks root (a file or directory) within fsys and reports its audio files.
+// prefix is prepended to paths within fsys to get the paths used in the database.
+// Archives are only walked within dirFS.
+func (w *fileWalker) walk(fsys fs.FS, prefix, root string) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return w.bad(prefix+p, err)
+		}
+		isLink := d.Type()&fs.ModeSymlink != 0
+		isDir := d.IsDir()
+		if isLink && w.opts.followSymlinks && prefix == "" {
+			fi, err := fs.Stat(fsys, p)
+			if err != nil {
+				return w.bad(p, err)
+			}
+			isDir = fi.IsDir()
+		}
+		// Ignore files and skip patterns aren't applied within archives.
+		if prefix == "" && p != "." {
+			// Explicitly-passed paths may be within ignored directories.
+			if ign, err := w.ignored(fsys, p, isDir, p == root); err != nil {
+				return err
+			} else if ign && d.IsDir() {
+				return fs.SkipDir
+			} else if ign {
+				return nil
+			}
+		}
+		if isLink && isDir {
+			// fs.WalkDir doesn't follow symlinks, but it follows its root.
+			w.links++
+			err := w.walk(fsys, prefix, p)
+			w.links--
+			return err
+		}
+		if d.IsDir() {
+			if w.opts.followSymlinks && prefix == "" {
+				// Skip directories that were already reached via other paths,
+				// which also avoids cycles.
+				if visited, err := w.visited(fsys, p); err != nil {
+					return err
+				} else if visited {
+					if w.opts.logSec > 0 {
+						log.Printf("Skipping %v: already visited", p)
+					}
+					return fs.SkipDir
+				}
+			}
+			// Handle CUE sheets before the audio files that they reference.
+			ents, err := fs.ReadDir(fsys, p)
+			if err != nil {
+				return err
+			}
+			for _, ent := range ents {
+				if ent.IsDir() || !cueRegexp.MatchString(ent.Name()) {
+					continue
+				}
+				cp := path.Join(p, ent.Name())
+				if prefix == "" {
+					if ign, err := w.ignored(fsys, cp, false, false); err != nil {
+						return err
+					} else if ign {
+						continue
+					}
+				}
+				if err := w.walkCueSheet(fsys, prefix, cp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		name := prefix + p
+		base := path.Base(p)
+		if p == root && cueRegexp.MatchString(base) {
+			// CUE sheets are usually handled along with their directories, but
+			// handle them here if they were passed explicitly.
+			return w.walkCueSheet(fsys, prefix, p)
+		}
+		isArchive := archiveRegexp.MatchString(base)
+		if !isArchive && !w.opts.fileRegexp.MatchString(base) {
+			return nil
+		}
+		if w.opts.followSymlinks && prefix == "" {
+			// Skip files that were already reached via other paths unless they're
+			// hardlinks (i.e. neither path traverses a symlink).
+			via := isLink || w.links > 0
+			if key, err := getFileKey(fsys, p); err != nil {
+				return w.bad(name, err)
+			} else if prev, ok := w.files[key]; ok && (prev || via) {
+				return nil
+			} else if !ok {
+				w.files[key] = via
+			}
+		}
+		if isArchive {
+			if dfs, ok := fsys.(dirFS); ok {
+				return w.walkArchive(filepath.Join(dfs.dir, filepath.FromSlash(p)), name)
+			}
+			return nil
+		}
+		if _, ok := w.cueFiles[name]; ok {
+			return nil
+		}
+
+		info, err := w.db.get(0, name)
+		if err != nil {
+			return fmt.Errorf("get %q: %v", name, err)
+		} else if info == nil && w.opts.skipNewFiles {
+			return nil
+		}
+		fi, err := fs.Stat(fsys, p) // follow symlinks
+		if err != nil {
+			return w.bad(name, err)
+		}
+
+		// Look for an earlier file with the same contents. Files within archives
+		// aren't checked.
+		var ident *fileIdentity
+		var rep fileID
+		if prefix == "" {
+			var id fileID
+			if info != nil {
+				id = info.id
+			}
+			if ident, rep, err = w.identify(fsys, p, fi, id); err != nil {
+				return w.bad(name, err)
+			}
+		}
+
+		if info == nil {
+			if rep != 0 {
+				// Reuse the identical file's fingerprint instead of running fpcalc again.
+				rinfo, err := w.db.get(rep, "")
+				if err != nil {
+					return fmt.Errorf("get %d: %v", rep, err)
+				} else if rinfo == nil {
+					return fmt.Errorf("%d not in database", rep)
+				}
+				info = &fileInfo{
+					path:     name,
+					size:     fi.Size(),
+					duration: rinfo.duration,
+					fprint:   rinfo.fprint,
+					short:    rinfo.short,
+				}
+			} else {
+				finfo, err := fingerprintFS(fsys, p, w.fps)
+				var short bool
+				if err == errEmptyFingerprint && w.opts.loopShortFiles {
+					// ffmpeg needs to be able to seek within the file to loop it.
+					if dfs, ok := fsys.(dirFS); ok {
+						finfo, err = runFpcalcLooped(filepath.Join(dfs.dir, filepath.FromSlash(p)), w.fps)
+						short = true
+					}
+				}
+				if err == errEmptyFingerprint {
+					return nil // skip short files
+				} else if err != nil {
+					return w.bad(name, err)
+				}
+				info = &fileInfo{
+					path:     name,
+					size:     fi.Size(),
+					duration: finfo.Duration,
+					fprint:   finfo.Fingerprint,
+					short:    short,
+				}
+			}
+			if info.id, err = w.db.save(info); err != nil {
+				return fmt.Errorf("save %q: %v", name, err)
+			}
+			if ident != nil && ident.hash != nil {
+				if err := w.db.saveHash(info.id, ident.hash); err != nil {
+					return fmt.Errorf("save hash %q: %v", name, err)
+				}
+			}
+		}
+		info.mask = w.db.mask(info.fprint)
+
+		if rep == 0 && ident != nil {
+			w.inodes[ident.key] = info.id
+			w.sizes[ident.size] = append(w.sizes[ident.size], info.id)
+		}
+		return w.report(info, rep)
+	})
+}
+
+// fileIdentity is used to find files with identical contents.
+type fileIdentity struct {
+	key  fileKey
+	size int64
+	hash []byte // nil if not computed
+}
+
+// identify looks for an earlier-reported file with the same contents as the file
+// at p within fsys, a dirFS. fi describes the file, and id is its ID if it's already
+// in the database. Hardlinks are identified via w.inodes, while files with sizes
+// matching others in w.sizes are hashed. If an identical file was found, its ID is
+// returned. nil is returned for empty files.
+func (w *fileWalker) identify(fsys fs.FS, p string, fi fs.FileInfo, id fileID) (*fileIdentity, fileID, error) {
+	if fi.Size() == 0 {
+		return nil, 0, nil
+	}
+	key, err := fileKeyOf(fsys, p, fi)
+	if err != nil {
+		return nil, 0, err
+	}
+	ident := &fileIdentity{key: key, size: fi.Size()}
+	if rep, ok := w.inodes[key]; ok {
+		return ident, rep, nil
+	}
+	for _, cand := range w.sizes[ident.size] {
+		if ident.hash == nil {
+			if ident.hash, err = w.hash(fsys, p, id); err != nil {
+				return nil, 0, err
+			}
+		}
+		cinfo, err := w.db.get(cand, "")
+		if err != nil {
+			return nil, 0, err
+		} else if cinfo == nil {
+			return nil, 0, fmt.Errorf("%d not in database", cand)
+		}
+		if chash, err := w.hash(fsys, cinfo.path, cand); err != nil {
+			return nil, 0, err
+		} else if bytes.Equal(ident.hash, chash) {
+			return ident, cand, nil
+		}
+	}
+	return ident, 0, nil
+}
+
+// hash returns a hash of the contents of the file at p within fsys.
+// If id is non-zero, the hash is loaded from or saved to w.db.
+func (w *fileWalker) hash(fsys fs.FS, p string, id fileID) ([]byte, error) {
+	if id != 0 {
+		if b, err := w.db.getHash(id); err != nil || b != nil {
+			return b, err
+		}
+	}
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	b := h.Sum(nil)
+	if id != 0 {
+		if err := w.db.saveHash(id, b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// visited returns true if the directory at p within fsys was already visited.
+// Otherwise, it's added to w.dirs.
+func (w *fileWalker) visited(fsys fs.FS, p string) (bool, error) {
+	key, err := getFileKey(fsys, p)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := w.dirs[key]; ok {
+		return true, nil
+	}
+	w.dirs[key] = struct{}{}
+	return false, nil
+}
+
+// ignored returns true if p (a directory if isDir is true) within fsys should be
+// skipped due to ignoreFile files in its ancestor directories or opts.skipRules.
+// If parents is true, p is also ignored if any of its ancestor directories are.
+func (w *fileWalker) ignored(fsys fs.FS, p string, isDir, parents bool) (bool, error) {
+	dirs := ancestorDirs(p)
+	if parents {
+		for _, d := range dirs[1:] {
+			if ign, err := w.ignored(fsys, d, true, false); err != nil || ign {
+				return ign, err
+			}
+		}
+	}
+	var ign bool
+	for _, d := range dirs {
+		rules, err := w.ignoreRules(fsys, d)
+		if err != nil {
+			return false, err
+		}
+		rel := p
+		if d != "." {
+			rel = strings.TrimPrefix(p, d+"/")
+		}
+		if i, ok := matchIgnoreRules(rules, rel, isDir); ok {
+			ign = i
+		}
+	}
+	return ign, nil
+}
+
+// ignoreRules returns the rules from the ignoreFile in dir within fsys, loading them
+// if needed. opts.skipRules are appended to the rules for the top-level directory.
+func (w *fileWalker) ignoreRules(fsys fs.FS, dir string) ([]ignoreRule, error) {
+	if rules, ok := w.ignores[dir]; ok {
+		return rules, nil
+	}
+	var rules []ignoreRule
+	p := path.Join(dir, ignoreFile)
+	if f, err := fsys.Open(p); err == nil {
+		rules, err = parseIgnoreRules(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if dir == "." {
+		rules = append(rules, w.opts.skipRules...)
+	}
+	w.ignores[dir] = rules
+	return rules, nil
+}
+
+// walkArchive walks the .zip archive at p, which is reported as name.
+func (w *fileWalker) walkArchive(p, name string) error {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return w.bad(name, err)
+	}
+	defer zr.Close()
+	return w.walk(zr, name+archiveSep, ".")
+}
+
+// walkCueSheet reports each track in the CUE sheet at cp within fsys.
+// The audio files referenced by the sheet are added to w.cueFiles.
+//
+// Each track is treated as a file with a path from trackPath. New tracks are
+// fingerprinted by fingerprinting the audio file and slicing out each track's
+// values, and are saved to db.
+func (w *fileWalker) walkCueSheet(fsys fs.FS, prefix, cp string) error {
+	tracks, err := readCueSheet(fsys, cp)
+	if err != nil {
+		return w.bad(prefix+cp, err)
+	}
+	for len(tracks) > 0 {
+		// Handle all of the tracks in the next audio file.
+		n := 1
+		for n < len(tracks) && tracks[n].file == tracks[0].file {
+			n++
+		}
+		ftracks := tracks[:n]
+		tracks = tracks[n:]
+
+		p := path.Join(path.Dir(cp), ftracks[0].file)
+		name := prefix + p
+		fi, err := fs.Stat(fsys, p)
+		if err != nil {
+			if err := w.bad(prefix+cp, err); err != nil {
+				return err
+			}
+			continue
+		}
+		w.cueFiles[name] = struct{}{}
+
+		infos := make([]*fileInfo, len(ftracks))
+		var missing bool
+		for i, t := range ftracks {
+			tp := trackPath(name, t.num)
+			if infos[i], err = w.db.get(0, tp); err != nil {
+				return fmt.Errorf("get %q: %v", tp, err)
+			} else if infos[i] == nil {
+				missing = true
+			}
+		}
+
+		if missing && !w.opts.skipNewFiles {
+			// Fingerprint enough of the file to cover the start of the last track.
+			settings := *w.fps
+			settings.length = ftracks[len(ftracks)-1].start + w.fps.length
+			res, err := fingerprintFS(fsys, p, &settings)
+			if err != nil {
+				if err := w.bad(name, err); err != nil {
+					return err
+				}
+				continue
+			}
+			for i, t := range ftracks {
+				if infos[i] != nil {
+					continue
+				}
+				end := t.end
+				if end == 0 {
+					end = res.Duration
+				}
+				start, stop := secondsToValues(t.start), secondsToValues(end)
+				if max := start + secondsToValues(w.fps.length); stop > max {
+					stop = max
+				}
+				if stop > len(res.Fingerprint) {
+					stop = len(res.Fingerprint)
+				}
+				if start >= stop {
+					continue // skip short or missing tracks
+				}
+				info := &fileInfo{
+					path:     trackPath(name, t.num),
+					size:     fi.Size(),
+					duration: end - t.start,
+					fprint:   res.Fingerprint[start:stop],
+				}
+				if info.id, err = w.db.save(info); err != nil {
+					return fmt.Errorf("save %q: %v", info.path, err)
+				}
+				infos[i] = info
+			}
+		}
+
+		for _, info := range infos {
+			if info != nil {
+				info.mask = w.db.mask(info.fprint)
+				if err := w.report(info, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dirFS is an fs.FS for a directory on disk. Unlike the fs.FS returned by os.DirFS,
+// it exposes the directory's path so that files can be passed directly to fpcalc.
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func newDirFS(dir string) dirFS { return dirFS{os.DirFS(dir), dir} }
+
+// fingerprintFS fingerprints the file at name within fsys per settings. Files in
+// dirFS are passed to fpcalc by path, while others are written to fpcalc's stdin.
+func fingerprintFS(fsys fs.FS, name string, settings *fpcalcSettings) (*fpcalcResult, error) {
+	if dfs, ok := fsys.(dirFS); ok {
+		return runFpcalc(filepath.Join(dfs.dir, filepath.FromSlash(name)), settings)
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return runFpcalcReader(f, settings)
+}
+
+// fingerprintPath fingerprints the file at p, a path reported by walkFiles for dir.
+func fingerprintPath(dir, p string, settings *fpcalcSettings) (*fpcalcResult, error) {
+	if archive, inner, ok := splitArchivePath(p); ok {
+		zr, err := zip.OpenReader(filepath.Join(dir, filepath.FromSlash(archive)))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return fingerprintFS(zr, inner, settings)
+	}
+	return fingerprintFS(newDirFS(dir), p, settings)
+}
+
+// fileKey uniquely identifies a file or directory.
+type fileKey struct {
+	dev, ino uint64
+	path     string // real path, used if the device and inode are unavailable
+}
+
+// getFileKey returns a key identifying the file at p within fsys, a dirFS.
+// Symlinks are followed.
+func getFileKey(fsys fs.FS, p string) (fileKey, error) {
+	fi, err := fs.Stat(fsys, p)
+	if err != nil {
+		return fileKey{}, err
+	}
+	return fileKeyOf(fsys, p, fi)
+}
+
+// fileKeyOf is like getFileKey but uses fi, which describes the file at p.
+func fileKeyOf(fsys fs.FS, p string, fi fs.FileInfo) (fileKey, error) {
+	if dev, ino, ok := fileDevIno(fi); ok {
+		return fileKey{dev: dev, ino: ino}, nil
+	}
+	rp, err := filepath.EvalSymlinks(filepath.Join(fsys.(dirFS).dir, filepath.FromSlash(p)))
+	return fileKey{path: rp}, err
+}
+
+// splitArchivePath splits a path like "a/b.zip!/c/d.mp3" into the archive's path
+// ("a/b.zip") and the path within the archive ("c/d.mp3"). false is returned if p
+// doesn't refer to a file within an archive.
+func splitArchivePath(p string) (archive, inner string, ok bool) {
+	i := strings.Index(p, archiveSep)
+	if i < 0 || !archiveRegexp.MatchString(p[:i]) {
+		return "", "", false
+	}
+	return p[:i], p[i+len(archiveSep):], true
+}
@@ -0,0 +1,312 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files (relative paths to contents) within dir.
+// Parent directories are created as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for p, data := range files {
+		fp := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestDB returns a new audioDB containing paths with placeholder fingerprints
+// so that walkFiles won't try to fingerprint them. The database is closed when
+// the test finishes.
+func newTestDB(t *testing.T, paths ...string) *audioDB {
+	db, err := newAudioDB(filepath.Join(t.TempDir(), "test.db"), defaultFpcalcSettings())
+	if err != nil {
+		t.Fatal("newAudioDB failed: ", err)
+	}
+	t.Cleanup(func() { db.close() })
+	for _, p := range paths {
+		if _, err := db.save(&fileInfo{path: p, fprint: []uint32{1, 2, 3}}); err != nil {
+			t.Fatalf("save %q failed: %v", p, err)
+		}
+	}
+	return db
+}
+
+// walkPaths finishes opts (using defaults if nil) and returns the paths reported
+// by walkFiles for dir.
+func walkPaths(t *testing.T, dir string, opts *scanOptions, db *audioDB) []string {
+	if opts == nil {
+		opts = defaultScanOptions()
+	}
+	if err := opts.finish(); err != nil {
+		t.Fatal("finish failed: ", err)
+	}
+	opts.logSec = 0
+	var paths []string
+	if err := walkFiles(dir, opts, db, defaultFpcalcSettings(), func(info *fileInfo, _ fileID) error {
+		paths = append(paths, info.path)
+		return nil
+	}); err != nil {
+		t.Fatal("walkFiles failed: ", err)
+	}
+	return paths
+}
+
+func TestWalkFiles_CueSheet(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Some Album.flac": "",
+		"bonus.flac":      "",
+		"album.cue":       testCueSheet,
+	})
+	// Save the tracks to the database so they won't be fingerprinted.
+	paths := []string{
+		trackPath("Some Album.flac", 1),
+		trackPath("Some Album.flac", 2),
+		trackPath("Some Album.flac", 3),
+		trackPath("bonus.flac", 4),
+	}
+	db := newTestDB(t, paths...)
+	if got := walkPaths(t, dir, nil, db); !reflect.DeepEqual(got, paths) {
+		t.Errorf("walkFiles reported %q; want %q", got, paths)
+	}
+}
+
+func TestWalkFiles_Archive(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "album.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, data := range map[string]string{
+		"album/01.mp3":    "",
+		"album/notes.txt": "",
+		"rip/rip.flac":    "",
+		"rip/rip.cue":     "FILE rip.flac WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:00\n",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"album.zip!/album/01.mp3", trackPath("album.zip!/rip/rip.flac", 1)}
+	db := newTestDB(t, paths...)
+	if got := walkPaths(t, dir, nil, db); !reflect.DeepEqual(got, paths) {
+		t.Errorf("walkFiles reported %q; want %q", got, paths)
+	}
+}
+
+func TestSplitArchivePath(t *testing.T) {
+	for _, tc := range []struct {
+		p              string
+		archive, inner string
+		ok             bool
+	}{
+		{"a/b.zip!/c/d.mp3", "a/b.zip", "c/d.mp3", true},
+		{"a/B.ZIP!/d.mp3", "a/B.ZIP", "d.mp3", true},
+		{"a/b.mp3", "", "", false},
+		{"a/wow!/b.mp3", "", "", false},
+	} {
+		if archive, inner, ok := splitArchivePath(tc.p); archive != tc.archive || inner != tc.inner || ok != tc.ok {
+			t.Errorf("splitArchivePath(%q) = %q, %q, %v; want %q, %q, %v",
+				tc.p, archive, inner, ok, tc.archive, tc.inner, tc.ok)
+		}
+	}
+}
+
+func TestWalkFiles_FilesFrom(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{"a/1.mp3", "a/2.mp3", "b/3.mp3", "c/4.mp3"}
+	files := make(map[string]string)
+	for _, p := range paths {
+		files[p] = ""
+	}
+	writeFiles(t, dir, files)
+	db := newTestDB(t, paths...)
+
+	opts := defaultScanOptions()
+	opts.skipBadFiles = true
+	opts.files = []string{
+		"a/1.mp3",
+		filepath.Join(dir, "b"),
+		filepath.Join(dir, "a/1.mp3"),       // duplicate
+		filepath.Join(t.TempDir(), "5.mp3"), // outside dir
+		"c/missing.mp3",
+	}
+	want := []string{"a/1.mp3", "b/3.mp3"}
+	if got := walkPaths(t, dir, opts, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("walkFiles reported %q; want %q", got, want)
+	}
+
+	// Relative paths should also work when dir itself is relative.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Dir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	rel := filepath.Base(dir)
+	opts.files = []string{"a/1.mp3", "./b", filepath.Join(dir, "c/4.mp3")}
+	want = []string{"a/1.mp3", "b/3.mp3", "c/4.mp3"}
+	if got := walkPaths(t, rel, opts, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("walkFiles with relative dir %q reported %q; want %q", rel, got, want)
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"a.mp3\nb/c.mp3\n", []string{"a.mp3", "b/c.mp3"}},
+		{"#EXTM3U\r\n#EXTINF:123,Artist - Title\r\na.mp3\r\n\r\nb.mp3", []string{"a.mp3", "b.mp3"}},
+		{"a.mp3\x00b\nc.mp3\x00#d.mp3\x00", []string{"a.mp3", "b\nc.mp3", "#d.mp3"}},
+	} {
+		if got, err := readFileList(strings.NewReader(tc.in)); err != nil {
+			t.Errorf("readFileList(%q) failed: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readFileList(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestWalkFiles_Ignore(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1.mp3":             "",
+		"Podcasts/2.mp3":    "",
+		"a/3.mp3":           "",
+		"a/4.mp3":           "",
+		"a/" + ignoreFile:   "4.mp3\n",
+		"b/5.mp3":           "",
+		"b/c/6.mp3":         "",
+		"b/c/" + ignoreFile: "*\n!7.mp3\n",
+		"b/c/7.mp3":         "",
+		"_incoming/x/8.mp3": "",
+		"_incoming/9.mp3":   "",
+	})
+	db := newTestDB(t, "1.mp3", "Podcasts/2.mp3", "a/3.mp3", "a/4.mp3", "b/5.mp3",
+		"b/c/6.mp3", "b/c/7.mp3", "_incoming/x/8.mp3", "_incoming/9.mp3")
+
+	for _, tc := range []struct {
+		files []string
+		want  []string
+	}{
+		{nil, []string{"1.mp3", "a/3.mp3", "b/5.mp3", "b/c/7.mp3"}},
+		{[]string{"a/4.mp3", "Podcasts/2.mp3", "_incoming/x", "b/c/7.mp3"}, []string{"b/c/7.mp3"}},
+	} {
+		opts := defaultScanOptions()
+		opts.skip = []string{"Podcasts/", "/_incoming"}
+		opts.files = tc.files
+		if got := walkPaths(t, dir, opts, db); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("walkFiles with files %q reported %q; want %q", tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestWalkFiles_FollowSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	writeFiles(t, dir, map[string]string{"disk1/a.mp3": ""})
+	writeFiles(t, other, map[string]string{"b.mp3": ""})
+	for _, err := range []error{
+		os.Link(filepath.Join(dir, "disk1/a.mp3"), filepath.Join(dir, "disk1/a-hard.mp3")),
+		os.Symlink("a.mp3", filepath.Join(dir, "disk1/a-link.mp3")),
+		os.Symlink("..", filepath.Join(dir, "disk1/loop")),
+		os.Symlink(other, filepath.Join(dir, "disk2")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := newTestDB(t, "disk1/a.mp3", "disk1/a-hard.mp3", "disk1/a-link.mp3", "disk2/b.mp3")
+
+	for _, tc := range []struct {
+		follow bool
+		want   []string
+	}{
+		{false, []string{"disk1/a-hard.mp3", "disk1/a-link.mp3", "disk1/a.mp3"}},
+		{true, []string{"disk1/a-hard.mp3", "disk1/a.mp3", "disk2/b.mp3"}},
+	} {
+		opts := defaultScanOptions()
+		opts.followSymlinks = tc.follow
+		if got := walkPaths(t, dir, opts, db); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("walkFiles with follow=%v reported %q; want %q", tc.follow, got, tc.want)
+		}
+	}
+}
+
+func TestWalkFiles_Identical(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.mp3": "abc", "c.mp3": "abc", "d.mp3": "abd", "e.mp3": "abcd"})
+	if err := os.Link(filepath.Join(dir, "a.mp3"), filepath.Join(dir, "b.mp3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only save some of the files to the database. The others should reuse a.mp3's
+	// fingerprint rather than being fingerprinted.
+	db := newTestDB(t)
+	aprint := []uint32{1, 2, 3}
+	ids := make(map[string]fileID)
+	for p, fp := range map[string][]uint32{"a.mp3": aprint, "d.mp3": {4, 5, 6}, "e.mp3": {7, 8, 9}} {
+		var err error
+		if ids[p], err = db.save(&fileInfo{path: p, fprint: fp}); err != nil {
+			t.Fatalf("save %q failed: %v", p, err)
+		}
+	}
+
+	opts := defaultScanOptions()
+	opts.skipBadFiles = false
+	if err := opts.finish(); err != nil {
+		t.Fatal("finish failed: ", err)
+	}
+	opts.logSec = 0
+	got := make(map[string]fileID)
+	if err := walkFiles(dir, opts, db, defaultFpcalcSettings(), func(info *fileInfo, rep fileID) error {
+		got[info.path] = rep
+		if rep != 0 && !reflect.DeepEqual(info.fprint, aprint) {
+			t.Errorf("%v has fingerprint %v; want %v", info.path, info.fprint, aprint)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal("walkFiles failed: ", err)
+	}
+	want := map[string]fileID{"a.mp3": 0, "b.mp3": ids["a.mp3"], "c.mp3": ids["a.mp3"], "d.mp3": 0, "e.mp3": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkFiles reported %v; want %v", got, want)
+	}
+
+	// The hashes of same-sized files should've been saved.
+	for _, p := range []string{"a.mp3", "c.mp3", "d.mp3"} {
+		if info, err := db.get(0, p); err != nil || info == nil {
+			t.Errorf("get %q failed: %v", p, err)
+		} else if hash, err := db.getHash(info.id); err != nil || hash == nil {
+			t.Errorf("getHash for %q returned %v, %v", p, hash, err)
+		}
+	}
+}